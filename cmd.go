@@ -8,6 +8,7 @@ import (
 	"log"
 	"net"
 	"strings"
+	"time"
 )
 
 var commands = make(map[string]cmd)
@@ -17,56 +18,70 @@ type cmd struct {
 	run  func([]string, io.Writer)
 }
 
-func defineReplayCmd(conf *Config) {
-	replayCmd := cmd{
-		name: "replay",
-		run: func(args []string, w io.Writer) {
-			var offset int64
-			var dest string
-			flags := flag.NewFlagSet("replay", flag.ContinueOnError)
-			flags.Int64Var(&offset, "offset", 0, "offset to read file from")
-			flags.StringVar(&dest, "dest", "", "logstash server group destination")
-
-			if err := flags.Parse(args); err != nil {
-				fmt.Fprintf(w, "argument error: %v")
-				fmt.Fprintf(w, "usage: replay [filename] [offset]")
-				return
-			}
-			args = flags.Args()
-			if len(args) == 0 {
-				fmt.Fprintf(w, "usage: replay [--offset=N] [--dest=...] [filename] [field1=value1 field2=value2 ... fieldN=valueN]\n")
-				return
-			}
-			for i, _ := range args {
-				args[i] = strings.TrimSpace(args[i])
-			}
-			fields := make(map[string]string, len(args)-1)
-			if len(args) > 1 {
-				for i := 1; i < len(args); i++ {
-					parts := strings.Split(args[i], "=")
-					if len(parts) != 2 {
-						fmt.Fprintf(w, "unable to parse field: %s", args[i])
-						return
-					}
-					fields[parts[0]] = strings.TrimSpace(parts[1])
+// replays a file from an offset, reading it through a decompressor if it is
+// compressed.  Files matching a files entry in the config are read with that
+// entry's settings, with any fields given on the command line added.
+var replayCmd = cmd{
+	name: "replay",
+	run: func(args []string, w io.Writer) {
+		var offset int64
+		var dest string
+		flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+		flags.Int64Var(&offset, "offset", 0, "offset to read file from")
+		flags.StringVar(&dest, "dest", "", "comma separated logstash server group destinations")
+
+		if err := flags.Parse(args); err != nil {
+			fmt.Fprintf(w, "argument error: %v\n", err)
+			fmt.Fprintf(w, "usage: replay [filename] [offset]\n")
+			return
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			fmt.Fprintf(w, "usage: replay [--offset=N] [--dest=...] [filename] [field1=value1 field2=value2 ... fieldN=valueN]\n")
+			return
+		}
+		for i, _ := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+		fields := make(map[string]interface{}, len(args)-1)
+		if len(args) > 1 {
+			for i := 1; i < len(args); i++ {
+				parts := strings.Split(args[i], "=")
+				if len(parts) != 2 {
+					fmt.Fprintf(w, "unable to parse field: %s\n", args[i])
+					return
 				}
+				fields[parts[0]] = strings.TrimSpace(parts[1])
 			}
-			var c chan *FileEvent
-			if dest != "" {
-				c = conf.Network.EventChan(dest)
-			} else {
-				c = conf.Network.EventChan(conf.FileDest(args[0]))
-			}
-			if c != nil {
-				fmt.Fprintf(w, "unable to get event chan for file path")
-				return
+		}
+
+		conf := running.current()
+		fileconfig := conf.fileConfig(args[0])
+		if fileconfig == nil {
+			fileconfig = &FileConfig{}
+		}
+		var c fanout
+		if dest != "" {
+			c = conf.Network.EventChans(strings.Split(dest, ","))
+		} else {
+			c = conf.Network.EventChans(fileconfig.Dest)
+		}
+		if c == nil {
+			fmt.Fprintf(w, "unable to get event chan for file path\n")
+			return
+		}
+		h := newHarvester(args[0], fileconfig, c, nil)
+		if len(fields) > 0 {
+			for k, v := range fileconfig.Fields {
+				if _, ok := fields[k]; !ok {
+					fields[k] = v
+				}
 			}
-			h := &Harvester{Path: args[0], Fields: fields, out: c, join: nil}
-			fmt.Fprintln(w, "ok")
-			go h.Harvest(offset, h_Rewind)
-		},
-	}
-	registerCmd(replayCmd)
+			h.Fields = fields
+		}
+		fmt.Fprintln(w, "ok")
+		go h.Harvest(offset, h_Rewind)
+	},
 }
 
 var infoCmd = cmd{
@@ -84,6 +99,47 @@ var infoCmd = cmd{
 	},
 }
 
+// removes progress entries for files that are gone, or have been replaced by
+// another file at the same path.
+var registryCmd = cmd{
+	name: "registry",
+	run: func(args []string, w io.Writer) {
+		var olderThan time.Duration
+		flags := flag.NewFlagSet("registry", flag.ContinueOnError)
+		flags.DurationVar(&olderThan, "older-than", options.ProgressRetention, "only prune entries that haven't changed for this long")
+
+		if len(args) == 0 || args[0] != "prune" {
+			fmt.Fprintf(w, "usage: registry prune [--older-than=DURATION]\n")
+			return
+		}
+		if err := flags.Parse(args[1:]); err != nil {
+			fmt.Fprintf(w, "argument error: %v\n", err)
+			return
+		}
+		removed, err := pruneProgress(olderThan)
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return
+		}
+		for _, path := range removed {
+			fmt.Fprintf(w, "pruned %s\n", path)
+		}
+		fmt.Fprintln(w, "ok")
+	},
+}
+
+var reloadCmd = cmd{
+	name: "reload",
+	run: func(args []string, w io.Writer) {
+		if err := reloadConfig(); err != nil {
+			log.Println(err)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	},
+}
+
 func registerCmd(c cmd) {
 	commands[c.name] = c
 }
@@ -145,4 +201,7 @@ func runCmd(conn net.Conn, line string) {
 
 func init() {
 	registerCmd(infoCmd)
+	registerCmd(registryCmd)
+	registerCmd(reloadCmd)
+	registerCmd(replayCmd)
 }
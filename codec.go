@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// codecs
+const (
+	codec_Plain  = "plain"  // the line is sent as is
+	codec_JSON   = "json"   // the line is a json object whose keys become fields
+	codec_Syslog = "syslog" // the line is an RFC3164 or RFC5424 syslog message
+)
+
+// what to do with lines a codec can't parse
+const (
+	onError_Plain = "plain" // send the line as is, with the error in a field
+	onError_Drop  = "drop"  // don't send the line at all
+)
+
+// the field that holds the parse error of a line sent as is.
+const codecErrorField = "codec_error"
+
+// type codec describes how a file's lines are turned into event fields.  It
+// may be given in the config as just the name of the codec, or as an object:
+//
+//	"codec": { "type": "json", "target": "app", "overwrite": true, "on_error": "drop" }
+type codec struct {
+	Type      string `json:"type"`
+	Target    string `json:"target"`    // field to put the parsed object in. merged into the event if empty.
+	Overwrite bool   `json:"overwrite"` // whether parsed keys replace the file's static fields
+	OnError   string `json:"on_error"`  // plain or drop
+}
+
+func (c *codec) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*c = codec{Type: name}
+	} else {
+		type plain codec
+		var v plain
+		if err := json.Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("cannot unmarshal codec: %v", err)
+		}
+		*c = codec(v)
+	}
+	return c.check()
+}
+
+// fills in defaults and rejects unknown settings.
+func (c *codec) check() error {
+	if c.Type == "" {
+		c.Type = codec_Plain
+	}
+	if c.OnError == "" {
+		c.OnError = onError_Plain
+	}
+	switch c.Type {
+	case codec_Plain, codec_JSON, codec_Syslog:
+	default:
+		return fmt.Errorf("unknown codec: %s", c.Type)
+	}
+	switch c.OnError {
+	case onError_Plain, onError_Drop:
+	default:
+		return fmt.Errorf("unknown codec on_error policy: %s", c.OnError)
+	}
+	return nil
+}
+
+// decodes the event's line into its fields.  Returns false if the event
+// should be dropped.  The event's text is left alone, since the registrar
+// relies on its length.
+func (c *codec) decode(e *FileEvent) bool {
+	var parsed map[string]interface{}
+	var err error
+	switch c.Type {
+	case codec_JSON:
+		parsed, err = decodeJSON(e.Text)
+	case codec_Syslog:
+		parsed, err = decodeSyslog(e.Text)
+	default:
+		return true
+	}
+	if err != nil {
+		if c.OnError == onError_Drop {
+			return false
+		}
+		e.Fields[codecErrorField] = err.Error()
+		return true
+	}
+
+	if c.Target != "" {
+		if _, ok := e.Fields[c.Target]; !ok || c.Overwrite {
+			e.Fields[c.Target] = parsed
+		}
+		return true
+	}
+	for k, v := range parsed {
+		if _, ok := e.Fields[k]; ok && !c.Overwrite {
+			continue
+		}
+		e.Fields[k] = v
+	}
+	return true
+}
+
+func decodeJSON(line string) (map[string]interface{}, error) {
+	var parsed map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader([]byte(line)))
+	d.UseNumber()
+	if err := d.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	if parsed == nil {
+		return nil, fmt.Errorf("line is not a json object")
+	}
+	return parsed, nil
+}
+
+var (
+	// <PRI>Mmm dd hh:mm:ss host program[pid]: message, where the priority
+	// is usually left out of files, and the timestamp may be RFC3339.
+	rfc3164 = regexp.MustCompile(`^(?:<(\d{1,3})>)?([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}|\d{4}-\d{2}-\d{2}T\S+) (\S+) (?:([^\s\[:]+)(?:\[(\d+)\])?: )?(.*)$`)
+
+	// the same without the host, as sent to /dev/log.  Tried first, so the
+	// program isn't taken for the host.
+	rfc3164Local = regexp.MustCompile(`^(?:<(\d{1,3})>)?([A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}|\d{4}-\d{2}-\d{2}T\S+) ([^\s\[:]+)(?:\[(\d+)\])?: (.*)$`)
+
+	// <PRI>1 timestamp host app procid msgid [structured data] message
+	rfc5424 = regexp.MustCompile(`^<(\d{1,3})>1 (\S+) (\S+) (\S+) (\S+) (\S+) (-|(?:\[(?:[^\]\\]|\\.)*\])+) ?(.*)$`)
+)
+
+// parses a syslog line into fields named as by logstash's syslog patterns.
+// The timestamp is left as it was written, since RFC3164 timestamps have no
+// year or zone.
+func decodeSyslog(line string) (map[string]interface{}, error) {
+	parsed := make(map[string]interface{}, 8)
+	set := func(key, value string) {
+		if value != "" && value != "-" {
+			parsed[key] = value
+		}
+	}
+
+	var pri string
+	if m := rfc5424.FindStringSubmatch(line); m != nil {
+		pri = m[1]
+		set("syslog_timestamp", m[2])
+		set("syslog_hostname", m[3])
+		set("syslog_program", m[4])
+		set("syslog_pid", m[5])
+		set("syslog_msgid", m[6])
+		set("syslog_structured_data", m[7])
+		set("syslog_message", m[8])
+	} else if m := rfc3164Local.FindStringSubmatch(line); m != nil {
+		pri = m[1]
+		set("syslog_timestamp", m[2])
+		set("syslog_program", m[3])
+		set("syslog_pid", m[4])
+		set("syslog_message", m[5])
+	} else if m := rfc3164.FindStringSubmatch(line); m != nil {
+		pri = m[1]
+		set("syslog_timestamp", m[2])
+		set("syslog_hostname", m[3])
+		set("syslog_program", m[4])
+		set("syslog_pid", m[5])
+		set("syslog_message", m[6])
+	} else {
+		return nil, fmt.Errorf("line is not a syslog message")
+	}
+
+	if pri != "" {
+		n, err := strconv.Atoi(pri)
+		if err != nil || n > 191 {
+			return nil, fmt.Errorf("bad syslog priority: %s", pri)
+		}
+		parsed["syslog_facility"] = n / 8
+		parsed["syslog_severity"] = n % 8
+	}
+	return parsed, nil
+}
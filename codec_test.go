@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCodecConfig(t *testing.T) {
+	var f FileConfig
+	if err := json.Unmarshal([]byte(`{"paths": ["/var/log/app.log"], "codec": "json"}`), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if f.Codec.Type != codec_JSON || f.Codec.OnError != onError_Plain {
+		t.Errorf("bad codec: %+v", f.Codec)
+	}
+
+	f = FileConfig{}
+	if err := json.Unmarshal([]byte(`{"paths": ["/var/log/app.log"], "codec": {"type": "json", "target": "app", "on_error": "drop"}}`), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if f.Codec.Target != "app" || f.Codec.OnError != onError_Drop {
+		t.Errorf("bad codec: %+v", f.Codec)
+	}
+
+	if err := json.Unmarshal([]byte(`{"codec": "xml"}`), &f); err == nil {
+		t.Errorf("unknown codec accepted")
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+	c := codec{Type: codec_JSON}
+	c.check()
+
+	e := &FileEvent{
+		Text:   `{"type": "overridden", "status": 200, "user": {"id": "x"}}`,
+		Fields: map[string]interface{}{"type": "app"},
+	}
+	if !c.decode(e) {
+		t.Fatalf("event dropped")
+	}
+	if e.Fields["type"] != "app" {
+		t.Errorf("static field overwritten: %v", e.Fields["type"])
+	}
+	if n, ok := e.Fields["status"].(json.Number); !ok || n.String() != "200" {
+		t.Errorf("bad number field: %#v", e.Fields["status"])
+	}
+	if _, ok := e.Fields["user"].(map[string]interface{}); !ok {
+		t.Errorf("bad object field: %#v", e.Fields["user"])
+	}
+
+	c.Overwrite = true
+	e.Fields = map[string]interface{}{"type": "app"}
+	c.decode(e)
+	if e.Fields["type"] != "overridden" {
+		t.Errorf("static field not overwritten: %v", e.Fields["type"])
+	}
+
+	c.Target = "app"
+	e.Fields = map[string]interface{}{}
+	c.decode(e)
+	if _, ok := e.Fields["app"].(map[string]interface{}); !ok || len(e.Fields) != 1 {
+		t.Errorf("parsed object not put in target: %v", e.Fields)
+	}
+}
+
+func TestJSONCodecErrors(t *testing.T) {
+	c := codec{Type: codec_JSON}
+	c.check()
+
+	e := &FileEvent{Text: "not json", Fields: map[string]interface{}{}}
+	if !c.decode(e) {
+		t.Fatalf("unparseable line dropped")
+	}
+	if _, ok := e.Fields[codecErrorField]; !ok {
+		t.Errorf("no parse error recorded: %v", e.Fields)
+	}
+
+	c.OnError = onError_Drop
+	if c.decode(&FileEvent{Text: "[1, 2]", Fields: map[string]interface{}{}}) {
+		t.Errorf("unparseable line sent")
+	}
+}
+
+func TestSyslogCodec(t *testing.T) {
+	c := codec{Type: codec_Syslog}
+	c.check()
+
+	e := &FileEvent{
+		Text:   "Oct 11 22:14:15 mymachine sshd[4123]: Accepted publickey for deploy",
+		Fields: map[string]interface{}{},
+	}
+	if !c.decode(e) {
+		t.Fatalf("event dropped")
+	}
+	for k, v := range map[string]interface{}{
+		"syslog_timestamp": "Oct 11 22:14:15",
+		"syslog_hostname":  "mymachine",
+		"syslog_program":   "sshd",
+		"syslog_pid":       "4123",
+		"syslog_message":   "Accepted publickey for deploy",
+	} {
+		if e.Fields[k] != v {
+			t.Errorf("field %s is %v, expected %v", k, e.Fields[k], v)
+		}
+	}
+	if _, ok := e.Fields["syslog_facility"]; ok {
+		t.Errorf("facility set without a priority: %v", e.Fields)
+	}
+
+	e = &FileEvent{
+		Text:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3"] An application event`,
+		Fields: map[string]interface{}{},
+	}
+	c.decode(e)
+	for k, v := range map[string]interface{}{
+		"syslog_timestamp":       "2003-10-11T22:14:15.003Z",
+		"syslog_hostname":        "mymachine.example.com",
+		"syslog_program":         "evntslog",
+		"syslog_msgid":           "ID47",
+		"syslog_structured_data": `[exampleSDID@32473 iut="3"]`,
+		"syslog_message":         "An application event",
+		"syslog_facility":        20,
+		"syslog_severity":        5,
+	} {
+		if e.Fields[k] != v {
+			t.Errorf("field %s is %v, expected %v", k, e.Fields[k], v)
+		}
+	}
+	if _, ok := e.Fields["syslog_pid"]; ok {
+		t.Errorf("nil pid set: %v", e.Fields)
+	}
+
+	// local messages, as sent to /dev/log, have no host.
+	e = &FileEvent{
+		Text:   "<13>Oct 11 22:14:15 myprog[123]: hello",
+		Fields: map[string]interface{}{},
+	}
+	c.decode(e)
+	for k, v := range map[string]interface{}{
+		"syslog_timestamp": "Oct 11 22:14:15",
+		"syslog_program":   "myprog",
+		"syslog_pid":       "123",
+		"syslog_message":   "hello",
+		"syslog_facility":  1,
+		"syslog_severity":  5,
+	} {
+		if e.Fields[k] != v {
+			t.Errorf("field %s is %v, expected %v", k, e.Fields[k], v)
+		}
+	}
+	if _, ok := e.Fields["syslog_hostname"]; ok {
+		t.Errorf("hostname set for a local message: %v", e.Fields)
+	}
+
+	e = &FileEvent{Text: "just some text", Fields: map[string]interface{}{}}
+	c.decode(e)
+	if _, ok := e.Fields[codecErrorField]; !ok {
+		t.Errorf("no parse error recorded: %v", e.Fields)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -8,7 +10,9 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,18 +20,31 @@ import (
 type Config struct {
 	Network NetworkConfig `json:network`
 	Files   []FileConfig  `json:files`
+	Inputs  []FileConfig  `json:"inputs"` // local sockets to read lines from
 }
 
-func (c *Config) FileDest(path string) string {
+func (c *Config) FileDest(path string) destList {
+	if f := c.fileConfig(path); f != nil {
+		return f.Dest
+	}
+	return destList{"default"}
+}
+
+// returns the files entry with a path or glob matching path, or nil.
+func (c *Config) fileConfig(path string) *FileConfig {
 	path = strings.TrimSpace(path)
-	for _, f := range c.Files {
+	for i, f := range c.Files {
+		if f.ExcludePaths.match(path) {
+			continue
+		}
 		for _, p := range f.Paths {
-			if path == strings.TrimSpace(p) {
-				return f.Dest
+			p = strings.TrimSpace(p)
+			if globMatch(p, path) || path == p {
+				return &c.Files[i]
 			}
 		}
 	}
-	return "default"
+	return nil
 }
 
 type NetworkConfig map[string]NetworkGroup
@@ -43,6 +60,15 @@ func (n NetworkConfig) UnmarshalJSON(data []byte) error {
 			g.Timeout = 15
 		}
 		g.timeout = time.Duration(g.Timeout) * time.Second
+		if g.Window == 0 {
+			g.Window = 4 * int(options.SpoolSize)
+		}
+		if err := g.checkProtocol(); err != nil {
+			return err
+		}
+		if err := g.checkMode(); err != nil {
+			return err
+		}
 		n[g.Name] = g
 		return nil
 	}
@@ -62,6 +88,15 @@ func (n NetworkConfig) UnmarshalJSON(data []byte) error {
 			g.Timeout = 15
 		}
 		g.timeout = time.Duration(g.Timeout) * time.Second
+		if g.Window == 0 {
+			g.Window = 4 * int(options.SpoolSize)
+		}
+		if err := g.checkProtocol(); err != nil {
+			return err
+		}
+		if err := g.checkMode(); err != nil {
+			return err
+		}
 		if g.c_events == nil {
 			g.c_events = make(chan *FileEvent, 16)
 		}
@@ -96,6 +131,23 @@ func (n NetworkConfig) EventChan(name string) chan *FileEvent {
 	return group.c_events
 }
 
+// returns the event channels of every named group, or nil if any of them
+// can't be found.  An empty list means the default group.
+func (n NetworkConfig) EventChans(names destList) fanout {
+	if len(names) == 0 {
+		names = destList{"default"}
+	}
+	out := make(fanout, 0, len(names))
+	for _, name := range names {
+		c := n.EventChan(name)
+		if c == nil {
+			return nil
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
 type NetworkGroup struct {
 	Name           string   `json:"name"`
 	Servers        []string `json:servers`
@@ -103,14 +155,67 @@ type NetworkGroup struct {
 	SSLKey         string   `json:"ssl key"`
 	SSLCA          string   `json:"ssl ca"`
 	Timeout        int64    `json:timeout`
+	Window         int      `json:"window"`       // max unacked events per server
+	Protocol       int      `json:"protocol"`     // lumberjack protocol version, 1 or 2
+	Mode           string   `json:"mode"`         // round_robin, failover or least_latency
+	MaxFailures    int      `json:"max_failures"` // failures before a server is suspended
+	Cooldown       int64    `json:"cooldown"`     // seconds a failed server is suspended for
 	timeout        time.Duration
 
 	c_events       chan *FileEvent // incoming file events
 	c_pages_unsent chan eventPage  // pages of events to be sent
 }
 
-func (n *NetworkGroup) Spool() {
-	go Spool(n.c_events, n.c_pages_unsent, options.SpoolSize, options.IdleTimeout)
+// fills in defaults for the options that control how pages are spread across
+// the group's servers.
+func (n *NetworkGroup) checkMode() error {
+	if n.Mode == "" {
+		n.Mode = mode_RoundRobin
+	}
+	if n.MaxFailures == 0 {
+		n.MaxFailures = 3
+	}
+	if n.Cooldown == 0 {
+		n.Cooldown = 30
+	}
+	if err := checkMode(n.Mode); err != nil {
+		return fmt.Errorf("NetworkGroup %s: %v", n.Name, err)
+	}
+	return nil
+}
+
+// defaults the protocol version to 1 and rejects anything we can't speak.
+func (n *NetworkGroup) checkProtocol() error {
+	switch n.Protocol {
+	case 0:
+		n.Protocol = 1
+	case 1, 2:
+	default:
+		return fmt.Errorf("NetworkGroup %s: unsupported protocol version: %d", n.Name, n.Protocol)
+	}
+	return nil
+}
+
+// starts the group's spooler, and its disk queue if one is configured.
+// Returns the channel the group's publishers should hand acknowledged pages
+// to.  The spooler stops waiting for full pages once flush is closed.
+func (n *NetworkGroup) Spool(registrar chan eventPage, flush <-chan struct{}) (chan eventPage, error) {
+	if options.QueueDir == "" {
+		go Spool(n.c_events, n.c_pages_unsent, options.SpoolSize, options.IdleTimeout, flush)
+		return registrar, nil
+	}
+
+	q, err := openQueue(filepath.Join(options.QueueDir, n.Name),
+		options.QueueMaxSize, options.QueueSegmentSize, options.QueueFsync)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open queue for network group %s: %v", n.Name, err)
+	}
+	spooled, acked := make(chan eventPage), make(chan eventPage, 1)
+	go Spool(n.c_events, spooled, options.SpoolSize, options.IdleTimeout, flush)
+	go q.fill(spooled, n.c_pages_unsent, registrar)
+	go q.drain(n.c_pages_unsent)
+	go q.track(acked, registrar)
+	return acked, nil
 }
 
 func (n *NetworkGroup) TLS() (*tls.Config, error) {
@@ -137,13 +242,152 @@ func (n *NetworkGroup) TLS() (*tls.Config, error) {
 	return &c, nil
 }
 
+// returns a digest of the contents of the group's TLS files, so that a reload
+// can tell whether they changed.  Read errors are left for TLS to report.
+func (n *NetworkGroup) tlsDigest() string {
+	h := sha1.New()
+	for _, path := range []string{n.SSLCertificate, n.SSLKey, n.SSLCA} {
+		if path == "" {
+			continue
+		}
+		raw, _ := ioutil.ReadFile(path)
+		h.Write(raw)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 type FileConfig struct {
-	Paths  []string          `json:paths`
-	Fields map[string]string `json:fields`
-	Join   joinspec          `json:join`
-	Dest   string            `json:"dest"`
+	Paths   []string               `json:paths`
+	Fields  map[string]interface{} `json:fields`
+	Join    joinspec               `json:join`
+	Dest    destList               `json:"dest"`
+	Listen  string                 `json:"listen"` // the socket of an input, e.g. udp://127.0.0.1:514
+	Codec   codec                  `json:"codec"`
+	Extract extractspec            `json:"extract"`
+	Include patternList            `json:"include"` // if given, only lines matching one of these are sent
+	Exclude patternList            `json:"exclude"` // lines matching any of these are never sent
+
+	ExcludePaths   globList    `json:"exclude_paths"`   // files, and directories, matching these aren't read
+	RotateSuffixes patternList `json:"rotate_suffixes"` // suffixes of rotated files, besides logrotate's
+
+	JoinMaxLines int   `json:"join_max_lines"` // most lines joined into one event
+	JoinMaxBytes int   `json:"join_max_bytes"` // most bytes joined into one event
+	JoinTimeout  int64 `json:"join_timeout"`   // seconds to wait for more lines to join
+
+	StartPosition startPosition `json:"start_position"` // where reading newly found files starts
+	IgnoreOlder   int64         `json:"ignore_older"`   // seconds since modification after which new files are skipped
+	ScanInterval  int64         `json:"scan_interval"`  // seconds between globbing for new files
+	CloseInactive int64         `json:"close_inactive"` // seconds without new lines after which a file is closed
+
+	raw string // the entry as it appeared in the config, compacted
+}
+
+// decodes the entry as usual, and remembers its json so that a reload can
+// tell which entries changed.
+func (f *FileConfig) UnmarshalJSON(b []byte) error {
+	type plain FileConfig
+	// an ignore_older of 0 turns the cutoff off, so its default is only
+	// used when it isn't given.
+	v := plain{IgnoreOlder: 24 * 60 * 60}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*f = FileConfig(v)
+	for name, n := range map[string]int64{
+		"ignore_older":   f.IgnoreOlder,
+		"scan_interval":  f.ScanInterval,
+		"close_inactive": f.CloseInactive,
+	} {
+		if n < 0 {
+			return fmt.Errorf("cannot unmarshal %s: %d is negative", name, n)
+		}
+	}
+	if f.JoinMaxLines == 0 {
+		f.JoinMaxLines = 500
+	}
+	if f.JoinMaxBytes == 0 {
+		f.JoinMaxBytes = 1 << 20
+	}
+	if f.JoinTimeout == 0 {
+		f.JoinTimeout = 5
+	}
+	if f.ScanInterval == 0 {
+		f.ScanInterval = 10
+	}
+	if f.CloseInactive == 0 {
+		f.CloseInactive = 24 * 60 * 60
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, b); err != nil {
+		return err
+	}
+	f.raw = buf.String()
+	return nil
+}
+
+// start positions
+const (
+	start_Beginning = "beginning"
+	start_End       = "end"
+	start_TailLines = "tail_lines" // given as tail_lines:N
+)
+
+// type startPosition is where reading a newly found file starts.  If it isn't
+// given, the -from-beginning flag decides.
+type startPosition struct {
+	where string
+	lines int // number of lines to read, for tail_lines
 }
 
+func (s *startPosition) UnmarshalJSON(b []byte) error {
+	var v string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("cannot unmarshal start_position: %v", err)
+	}
+	switch {
+	case v == start_Beginning || v == start_End:
+		*s = startPosition{where: v}
+	case strings.HasPrefix(v, start_TailLines+":"):
+		n, err := strconv.Atoi(strings.TrimPrefix(v, start_TailLines+":"))
+		if err != nil || n < 0 {
+			return fmt.Errorf("cannot unmarshal start_position: bad line count: %s", v)
+		}
+		*s = startPosition{where: start_TailLines, lines: n}
+	default:
+		return fmt.Errorf("cannot unmarshal start_position: unknown position: %s", v)
+	}
+	return nil
+}
+
+func (s startPosition) fromBeginning() bool {
+	return s.where == start_Beginning || (s.where == "" && options.FromBeginning)
+}
+
+// type destList is the list of network groups a file is sent to.  It may be
+// given in the config as a single group name or a list of them.
+type destList []string
+
+func (d *destList) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*d = destList{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return fmt.Errorf("cannot unmarshal dest: %v", err)
+	}
+	*d = names
+	return nil
+}
+
+// join specifiers
+const (
+	join_Previous = "previous" // the line is joined to the one before it
+	join_Next     = "next"     // the line after this one is joined to it
+)
+
 type joinspec []joinspecElem
 
 type joinspecElem struct {
@@ -187,7 +431,7 @@ func (j *joinspec) UnmarshalJSON(b []byte) error {
 			}
 		}
 
-		if v[i].With != "previous" {
+		if v[i].With != join_Previous && v[i].With != join_Next {
 			return fmt.Errorf("cannot unmarshal joinspec: illegal with specifier: %v", v[i].With)
 		}
 
@@ -198,6 +442,162 @@ func (j *joinspec) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// type extractspec is a list of regular expressions whose named groups are
+// captured into event fields.
+type extractspec []*regexp.Regexp
+
+func (x *extractspec) UnmarshalJSON(b []byte) error {
+	type t []struct {
+		Match string `json:"match"`
+	}
+
+	var v t
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("cannot unmarshal extract: %v", err)
+	}
+
+	tmp := make(extractspec, len(v))
+	for i := range v {
+		re, err := regexp.Compile(v[i].Match)
+		if err != nil {
+			return fmt.Errorf("cannot unmarshal extract: illegal match pattern: %v", err)
+		}
+		named := false
+		for _, name := range re.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return fmt.Errorf("cannot unmarshal extract: pattern has no named groups: %s", v[i].Match)
+		}
+		tmp[i] = re
+	}
+	*x = tmp
+	return nil
+}
+
+// sets a field for every named group captured from the event's line.  Groups
+// that don't take part in a match are left out.
+func (x extractspec) apply(e *FileEvent) {
+	for _, re := range x {
+		m := re.FindStringSubmatchIndex(e.Text)
+		if m == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if name == "" || m[2*i] < 0 {
+				continue
+			}
+			e.Fields[name] = e.Text[m[2*i]:m[2*i+1]]
+		}
+	}
+}
+
+// type patternList is a list of regular expressions given as strings.
+type patternList []*regexp.Regexp
+
+func (l *patternList) UnmarshalJSON(b []byte) error {
+	var v []string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("cannot unmarshal pattern list: %v", err)
+	}
+	tmp := make(patternList, len(v))
+	for i, s := range v {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("bad pattern in pattern list: %v", err)
+		}
+		tmp[i] = re
+	}
+	*l = tmp
+	return nil
+}
+
+// reports whether any of the patterns match the line.
+func (l patternList) match(line string) bool {
+	for _, re := range l {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// type globList is a list of globs, which may use **, for paths to leave out.
+type globList []string
+
+func (l *globList) UnmarshalJSON(b []byte) error {
+	var v []string
+	if err := json.Unmarshal(b, &v); err != nil {
+		return fmt.Errorf("cannot unmarshal glob list: %v", err)
+	}
+	for _, glob := range v {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return fmt.Errorf("bad glob in glob list: %s", glob)
+		}
+	}
+	*l = globList(v)
+	return nil
+}
+
+// reports whether path, or any directory it is in, matches one of the globs.
+func (l globList) match(path string) bool {
+	if len(l) == 0 {
+		return false
+	}
+	segments := globSegments(path)
+	for _, glob := range l {
+		g := globSegments(glob)
+		for i := len(segments); i > 0; i-- {
+			if matchSegments(g, segments[:i], false) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// returns the paths that don't match.
+func (l globList) filter(paths []string) []string {
+	if len(l) == 0 {
+		return paths
+	}
+	kept := paths[:0]
+	for _, path := range paths {
+		if !l.match(path) {
+			kept = append(kept, path)
+		}
+	}
+	return kept
+}
+
+// reports whether any element with the given specifier matches the line.
+// The line's newline isn't matched against, so that patterns may use $.
+func (j joinspec) joins(with string, line []byte) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	for _, v := range j {
+		if v.with != with {
+			continue
+		}
+		if v.match != nil && v.match.Match(line) {
+			return true
+		}
+		if v.not != nil && !v.not.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// reports whether the spec has any elements with the given specifier.
+func (j joinspec) has(with string) bool {
+	for _, v := range j {
+		if v.with == with {
+			return true
+		}
+	}
+	return false
+}
+
 type shittyjoinspec struct {
 	Before []regexp.Regexp
 }
@@ -261,5 +661,18 @@ func LoadConfig(path string) (*Config, error) {
 	if err := json.NewDecoder(f).Decode(&conf); err != nil {
 		return nil, fmt.Errorf("failed unmarshalling config json: %s\n", err)
 	}
+	for _, fileconfig := range conf.Files {
+		if fileconfig.Listen != "" {
+			return nil, fmt.Errorf("files entry with listen address %s belongs in inputs\n", fileconfig.Listen)
+		}
+	}
+	for _, input := range conf.Inputs {
+		if len(input.Paths) > 0 {
+			return nil, fmt.Errorf("inputs entry with paths %v belongs in files\n", input.Paths)
+		}
+		if _, _, err := parseListen(input.Listen); err != nil {
+			return nil, fmt.Errorf("invalid input: %v\n", err)
+		}
+	}
 	return &conf, nil
 }
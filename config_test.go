@@ -31,3 +31,83 @@ func TestJSONLoading(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestDestList(t *testing.T) {
+	var f FileConfig
+	if err := json.Unmarshal([]byte(`{"paths": ["/var/log/audit.log"], "dest": "security"}`), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if len(f.Dest) != 1 || f.Dest[0] != "security" {
+		t.Errorf("bad single dest: %v", f.Dest)
+	}
+
+	f = FileConfig{}
+	if err := json.Unmarshal([]byte(`{"paths": ["/var/log/audit.log"], "dest": ["default", "security"]}`), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if len(f.Dest) != 2 || f.Dest[0] != "default" || f.Dest[1] != "security" {
+		t.Errorf("bad dest list: %v", f.Dest)
+	}
+}
+
+func TestFanoutAcknowledge(t *testing.T) {
+	a, b := make(chan *FileEvent, 1), make(chan *FileEvent, 1)
+	e := &FileEvent{Source: "/var/log/audit.log"}
+	fanout{a, b}.send(e, nil)
+
+	page := eventPage{<-a}
+	if done := page.acknowledge(); len(done) != 0 {
+		t.Errorf("event acknowledged after only one of two destinations")
+	}
+	page = eventPage{<-b}
+	if done := page.acknowledge(); len(done) != 1 {
+		t.Errorf("event not acknowledged after both destinations")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	var f FileConfig
+	conf := `{"paths": ["/var/log/httpd/access_log"], "extract": [
+		{"match": "\" (?P<status>\\d{3}) "},
+		{"match": "request_id=(?P<request_id>\\w+)|(?P<nothing>x{5})"}
+	]}`
+	if err := json.Unmarshal([]byte(conf), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+
+	e := &FileEvent{
+		Text:   `127.0.0.1 - - "GET / HTTP/1.1" 404 512 request_id=abc123`,
+		Fields: map[string]interface{}{},
+	}
+	f.Extract.apply(e)
+	if e.Fields["status"] != "404" || e.Fields["request_id"] != "abc123" {
+		t.Errorf("bad extracted fields: %v", e.Fields)
+	}
+	if _, ok := e.Fields["nothing"]; ok {
+		t.Errorf("unmatched group extracted: %v", e.Fields)
+	}
+
+	if err := json.Unmarshal([]byte(`{"extract": [{"match": "\\d+"}]}`), &f); err == nil {
+		t.Errorf("pattern without named groups accepted")
+	}
+}
+
+func TestLineFilters(t *testing.T) {
+	var f FileConfig
+	conf := `{"paths": ["/var/log/app.log"], "include": ["ERROR", "WARN"], "exclude": ["healthcheck"]}`
+	if err := json.Unmarshal([]byte(conf), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	h := newHarvester("/var/log/app.log", &f, nil, nil)
+
+	for line, want := range map[string]bool{
+		"ERROR disk full":           true,
+		"WARN slow request":         true,
+		"INFO started":              false,
+		"ERROR healthcheck timeout": false,
+	} {
+		if got := h.event(line, 0) != nil; got != want {
+			t.Errorf("line %q sent: %v, expected %v", line, got, want)
+		}
+	}
+}
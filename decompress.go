@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// returns a reader of the decompressed contents of f if it is gzip or bzip2
+// compressed, as told by its first bytes, or nil if it isn't compressed.  The
+// returned reader starts at the beginning of the file, whatever f's position.
+func decompressor(f *os.File) (io.Reader, error) {
+	magic := make([]byte, 3)
+	n, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to read file type: %v", err)
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		z, err := gzip.NewReader(io.NewSectionReader(f, 0, 1<<62))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read gzip file: %v", err)
+		}
+		return z, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(io.NewSectionReader(f, 0, 1<<62)), nil
+	}
+	return nil, nil
+}
+
+// skips the first n bytes of r.
+func skip(r io.Reader, n int64) error {
+	skipped, err := io.CopyN(ioutil.Discard, r, n)
+	if err == io.EOF {
+		return fmt.Errorf("only %d bytes to skip", skipped)
+	}
+	return err
+}
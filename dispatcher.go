@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// network group modes
+const (
+	mode_RoundRobin   = "round_robin"
+	mode_Failover     = "failover"
+	mode_LeastLatency = "least_latency"
+)
+
+// type dispatcher hands pages from a network group's spool to the group's
+// publishers, choosing a publisher according to the group's mode.  Pages are
+// only handed to a publisher that is ready to send them, so a publisher stuck
+// reconnecting never holds on to a page that another server could take.
+type dispatcher struct {
+	name       string
+	mode       string
+	publishers []*Publisher
+	next       int           // next publisher to try, in round robin mode
+	wake       chan struct{} // signalled when a publisher may be ready for a page
+	quit       chan struct{} // closed to stop the dispatcher and its publishers
+
+	group NetworkGroup // the settings the publishers were started with
+	tls   string       // digest of the group's TLS files when started
+}
+
+func newDispatcher(group NetworkGroup) *dispatcher {
+	return &dispatcher{
+		name:  group.Name,
+		mode:  group.Mode,
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		group: group,
+		tls:   group.tlsDigest(),
+	}
+}
+
+func (d *dispatcher) add(p *Publisher) {
+	p.input = make(chan eventPage)
+	p.wake = d.wake
+	p.quit = d.quit
+	d.publishers = append(d.publishers, p)
+}
+
+func (d *dispatcher) run(input chan eventPage) {
+	for {
+		select {
+		case page := <-input:
+			if !d.dispatch(page) {
+				go requeue(input, []eventPage{page})
+				return
+			}
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// blocks until some publisher accepts the page.  Returns false if the
+// dispatcher is stopped first.
+func (d *dispatcher) dispatch(page eventPage) bool {
+	for {
+		for _, i := range d.candidates() {
+			select {
+			case d.publishers[i].input <- page:
+				d.next = i + 1
+				return true
+			default:
+			}
+		}
+		select {
+		case <-d.wake:
+		case <-time.After(100 * time.Millisecond):
+		case <-d.quit:
+			return false
+		}
+	}
+}
+
+// stops the dispatcher and its publishers.  Pages they hold are handed back
+// to the network group, for whichever publishers replace them.
+func (d *dispatcher) stop() {
+	close(d.quit)
+}
+
+// whether the publishers were started with the same settings as group.  TLS
+// files are compared by content, so replacing a certificate in place counts
+// as a change.
+func (d *dispatcher) same(group NetworkGroup) bool {
+	return reflect.DeepEqual(d.group, group) && d.tls == group.tlsDigest()
+}
+
+// candidates returns the indexes of the publishers that may be given the next
+// page, in order of preference.  Publishers whose circuit breaker is open are
+// skipped, unless every publisher in the group is failing.
+func (d *dispatcher) candidates() []int {
+	if len(d.publishers) == 0 {
+		return nil
+	}
+	healthy := make([]int, 0, len(d.publishers))
+	for i, p := range d.publishers {
+		if p.healthy() {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		for i := range d.publishers {
+			healthy = append(healthy, i)
+		}
+	}
+
+	switch d.mode {
+	case mode_Failover:
+		return healthy[:1]
+	case mode_LeastLatency:
+		sort.Stable(byLatency{healthy, d.publishers})
+		return healthy
+	default:
+		// rotate so that we start with the publisher after the last one used.
+		start := 0
+		for start < len(healthy) && healthy[start] < d.next%len(d.publishers) {
+			start++
+		}
+		rotated := make([]int, 0, len(healthy))
+		rotated = append(rotated, healthy[start:]...)
+		return append(rotated, healthy[:start]...)
+	}
+}
+
+// sorts publisher indexes by measured ack round-trip time.  Publishers with
+// nothing measured yet come last, so they're only used when the others are
+// busy.
+type byLatency struct {
+	idx        []int
+	publishers []*Publisher
+}
+
+func (b byLatency) Len() int      { return len(b.idx) }
+func (b byLatency) Swap(i, j int) { b.idx[i], b.idx[j] = b.idx[j], b.idx[i] }
+func (b byLatency) Less(i, j int) bool {
+	a, c := b.publishers[b.idx[i]].latency(), b.publishers[b.idx[j]].latency()
+	if a == 0 || c == 0 {
+		return c == 0 && a != 0
+	}
+	return a < c
+}
+
+func checkMode(mode string) error {
+	switch mode {
+	case mode_RoundRobin, mode_Failover, mode_LeastLatency:
+		return nil
+	}
+	return fmt.Errorf("unknown network group mode: %s", mode)
+}
+
+// requeue hands pages back to a network group so that another publisher can
+// send them.
+func requeue(group chan eventPage, pages []eventPage) {
+	for _, page := range pages {
+		group <- page
+	}
+	log.Printf("requeued %d pages", len(pages))
+}
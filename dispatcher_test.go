@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// returns a publisher whose circuit breaker is open if failing, with rtt as
+// its measured latency.
+func testPublisher(failing bool, rtt time.Duration) *Publisher {
+	p := &Publisher{}
+	p.health.maxFailures = 3
+	p.health.cooldown = time.Minute
+	p.health.rtt = rtt
+	if failing {
+		p.health.failures = 3
+		p.health.openUntil = time.Now().Add(time.Minute)
+	}
+	return p
+}
+
+func TestCandidates(t *testing.T) {
+	ms := time.Millisecond
+	for _, c := range []struct {
+		mode    string
+		next    int
+		failing []bool
+		rtt     []time.Duration
+		want    []int
+	}{
+		{mode_RoundRobin, 0, []bool{false, false, false}, nil, []int{0, 1, 2}},
+		{mode_RoundRobin, 1, []bool{false, false, false}, nil, []int{1, 2, 0}},
+		{mode_RoundRobin, 3, []bool{false, false, false}, nil, []int{0, 1, 2}},
+		{mode_RoundRobin, 1, []bool{false, true, false}, nil, []int{2, 0}},
+		{mode_Failover, 2, []bool{false, false, false}, nil, []int{0}},
+		{mode_Failover, 0, []bool{true, false, false}, nil, []int{1}},
+		{mode_Failover, 0, []bool{true, true, true}, nil, []int{0}},
+		{mode_LeastLatency, 0, []bool{false, false, false}, []time.Duration{30 * ms, 10 * ms, 20 * ms}, []int{1, 2, 0}},
+		{mode_LeastLatency, 0, []bool{false, false, false}, []time.Duration{0, 30 * ms, 10 * ms}, []int{2, 1, 0}},
+		{mode_LeastLatency, 0, []bool{false, true, false}, []time.Duration{30 * ms, 10 * ms, 20 * ms}, []int{2, 0}},
+	} {
+		d := &dispatcher{mode: c.mode, next: c.next}
+		for i, failing := range c.failing {
+			var rtt time.Duration
+			if c.rtt != nil {
+				rtt = c.rtt[i]
+			}
+			d.publishers = append(d.publishers, testPublisher(failing, rtt))
+		}
+		if got := d.candidates(); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s with next %d, failing %v and rtt %v: expected %v, got %v", c.mode, c.next, c.failing, c.rtt, c.want, got)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	p := testPublisher(false, 0)
+	p.health.maxFailures = 2
+	p.health.cooldown = 50 * time.Millisecond
+
+	if p.failed() || !p.healthy() {
+		t.Fatalf("breaker opened after one failure")
+	}
+	if !p.failed() || p.healthy() {
+		t.Fatalf("breaker didn't open after two failures")
+	}
+
+	// half open once the cooldown has passed, and open again on the next
+	// failure.
+	time.Sleep(60 * time.Millisecond)
+	if !p.healthy() {
+		t.Fatalf("breaker still open after its cooldown")
+	}
+	if !p.failed() || p.healthy() {
+		t.Fatalf("breaker didn't reopen on a failure while half open")
+	}
+
+	p.succeeded(0)
+	if !p.healthy() {
+		t.Errorf("breaker still open after an ack")
+	}
+}
+
+func TestHandBack(t *testing.T) {
+	group := make(chan eventPage, 4)
+	p := testPublisher(false, 0)
+	p.health.maxFailures = 2
+	p.group = group
+	a, b := testEvents("a", 3), testEvents("b", 2)
+	p.inflight = []*pendingPage{{page: a, acked: 1}, {page: b}}
+
+	// nothing is handed back until the breaker opens.
+	p.fail()
+	if len(p.inflight) != 2 {
+		t.Fatalf("events handed back before the breaker opened")
+	}
+	p.fail()
+	if len(p.inflight) != 0 {
+		t.Errorf("expected nothing left in flight, got %d pages", len(p.inflight))
+	}
+	for _, want := range []string{"a1 a2", "b0 b1"} {
+		select {
+		case page := <-group:
+			var lines []string
+			for _, e := range page {
+				lines = append(lines, e.Text)
+			}
+			if got := fmt.Sprint(lines); got != "["+want+"]" {
+				t.Errorf("expected [%s] handed back, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected [%s] handed back", want)
+		}
+	}
+}
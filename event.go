@@ -2,9 +2,12 @@ package main
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"strconv"
+	"sync/atomic"
 )
 
 // type FileEvent represents a single event in a log file.  I.e., it represents
@@ -13,29 +16,167 @@ type FileEvent struct {
 	Source  string
 	Offset  int64
 	Text    string
-	Fields  map[string]string
+	Host    string // the host the event came from, if not this one
+	Fields  map[string]interface{}
 	Rotated bool
 
 	fileinfo os.FileInfo
+
+	// the number of network groups the event was sent to, and how many of
+	// them have acknowledged it so far.  acks is only touched by the
+	// registrar.
+	dests   int
+	acks    int
+	dropped int32 // set once the event is given up on, as by drop
+
+	queued *queueRecord // the disk queue page the event was read from, if any
+
+	seq uint64 // the order the event was read in, across all files
+
+	// where the bytes of the event's line end in its file, and the last of
+	// them, for the progress file.  Text is trimmed, so doesn't tell.
+	end  int64
+	tail string
+}
+
+// the number of events sent to network groups that the registrar hasn't yet
+// recorded as acknowledged by all of them.  Shutdown waits for it to reach
+// zero.
+var unacknowledged int64
+
+// the number of events read so far, to order them by.
+var readSequence uint64
+
+// type fanout is the set of network group event channels a harvester sends
+// its events to.
+type fanout []chan *FileEvent
+
+// sends the event to every destination.  The same event is shared between
+// destinations, so it must not be modified once sent.  Gives up and returns
+// false if quit is closed first.
+func (f fanout) send(e *FileEvent, quit <-chan struct{}) bool {
+	e.dests = len(f)
+	e.seq = atomic.AddUint64(&readSequence, 1)
+	atomic.AddInt64(&unacknowledged, 1)
+	for _, c := range f {
+		select {
+		case c <- e:
+		case <-quit:
+			e.drop()
+			return false
+		}
+	}
+	return true
+}
+
+// records where the bytes of the event's line, raw, end in its file.  Returns
+// the event, which may be nil.
+func (e *FileEvent) ending(raw []byte, end int64) *FileEvent {
+	if e == nil {
+		return nil
+	}
+	if len(raw) > progressTailSize {
+		raw = raw[len(raw)-progressTailSize:]
+	}
+	e.end = end
+	e.tail = string(raw)
+	return e
 }
 
+// gives up on the event, which can never be acknowledged by every destination
+// now, so that shutdown doesn't wait for it.
+func (e *FileEvent) drop() {
+	if atomic.CompareAndSwapInt32(&e.dropped, 0, 1) {
+		atomic.AddInt64(&unacknowledged, -1)
+	}
+}
+
+// records an acknowledgement from one destination, returning true once every
+// destination has acknowledged the event.
+func (e *FileEvent) acknowledge() bool {
+	e.acks++
+	return e.acks >= e.dests
+}
+
+// the keys every frame carries for the event itself.  A field with one of
+// these names is left out of frames, so they always mean the same thing
+// whichever protocol is used.
+var reservedKeys = map[string]bool{"file": true, "host": true, "offset": true, "line": true}
+
+// writes the event as a v1 data frame.  Field values that aren't strings are
+// flattened to their JSON representation.
 func (e *FileEvent) writeFrame(w io.Writer, id uint32) {
+	n := 4
+	for k := range e.Fields {
+		if !reservedKeys[k] {
+			n++
+		}
+	}
 	w.Write([]byte("1D"))
 	binary.Write(w, binary.BigEndian, id)
-	binary.Write(w, binary.BigEndian, uint32(len(e.Fields)+4))
+	binary.Write(w, binary.BigEndian, uint32(n))
 
 	writeKV("file", e.Source, w)
-	writeKV("host", hostname, w)
+	writeKV("host", e.host(), w)
 	writeKV("offset", strconv.FormatInt(e.Offset, 10), w)
 	writeKV("line", e.Text, w)
 	for k, v := range e.Fields {
-		writeKV(k, v, w)
+		if !reservedKeys[k] {
+			writeKV(k, fieldString(v), w)
+		}
 	}
 }
 
+// writes the event as a v2 json frame, preserving the types of field values.
+func (e *FileEvent) writeJSONFrame(w io.Writer, id uint32) error {
+	doc := make(map[string]interface{}, len(e.Fields)+4)
+	for k, v := range e.Fields {
+		if !reservedKeys[k] {
+			doc[k] = v
+		}
+	}
+	doc["file"] = e.Source
+	doc["host"] = e.host()
+	doc["offset"] = e.Offset
+	doc["line"] = e.Text
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("unable to encode event as json: %v", err)
+	}
+	w.Write([]byte("2J"))
+	binary.Write(w, binary.BigEndian, id)
+	binary.Write(w, binary.BigEndian, uint32(len(b)))
+	w.Write(b)
+	return nil
+}
+
+func (e *FileEvent) host() string {
+	if e.Host != "" {
+		return e.Host
+	}
+	return hostname
+}
+
 func writeKV(key string, value string, output io.Writer) {
 	binary.Write(output, binary.BigEndian, uint32(len(key)))
 	output.Write([]byte(key))
 	binary.Write(output, binary.BigEndian, uint32(len(value)))
 	output.Write([]byte(value))
 }
+
+// renders a field value as a string for protocols that only support string
+// values.
+func fieldString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case nil:
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
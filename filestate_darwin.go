@@ -1,8 +1,20 @@
 package main
 
+import "fmt"
+
 type FileState struct {
-	Source string `json:"source"`
-	Offset int64  `json:"offset"`
-	Inode  uint64 `json:"inode"`
-	Device int32  `json:"device"`
+	Source  string `json:"source"`
+	Offset  int64  `json:"offset"`
+	Inode   uint64 `json:"inode"`
+	Device  int32  `json:"device"`
+	Updated int64  `json:"updated,omitempty"` // unix time the offset was recorded
+	Tail    string `json:"tail,omitempty"`    // the last bytes read before offset
+
+	seq uint64 // the order the offset was read in, as FileEvent.seq
+}
+
+// returns the key of the file's progress: its inode and device, so that it
+// is found again after the file is renamed.
+func (s *FileState) key() string {
+	return fmt.Sprintf("%v_%v", s.Inode, s.Device)
 }
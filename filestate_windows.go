@@ -1,8 +1,18 @@
 package main
 
 type FileState struct {
-	Source string `json:"source"`
-	Offset int64  `json:"offset"`
-	Inode  uint64 `json:"inode"`
-	Device uint64 `json:"device"`
+	Source  string `json:"source"`
+	Offset  int64  `json:"offset"`
+	Inode   uint64 `json:"inode"`
+	Device  uint64 `json:"device"`
+	Updated int64  `json:"updated,omitempty"` // unix time the offset was recorded
+	Tail    string `json:"tail,omitempty"`    // the last bytes read before offset
+
+	seq uint64 // the order the offset was read in, as FileEvent.seq
+}
+
+// returns the key of the file's progress.  Windows has no inodes, so it's the
+// file's path.
+func (s *FileState) key() string {
+	return s.Source
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// frame types, as described in PROTOCOL.md
+const (
+	frameData       = 'D'
+	frameJSON       = 'J'
+	frameWindow     = 'W'
+	frameCompressed = 'C'
+	frameAck        = 'A'
+)
+
+// the longest key, value or json payload read from a frame.  Lengths come
+// from the other end, so a bad one mustn't make us allocate gigabytes.
+const maxFrameString = 64 << 20
+
+// type frame is a single decoded lumberjack protocol frame.  Compressed frames
+// are never returned by a frameReader; their contents are returned instead.
+type frame struct {
+	version byte
+	kind    byte
+	seq     uint32                 // sequence number of data, json and ack frames
+	window  uint32                 // window size of window frames
+	fields  map[string]interface{} // payload of data and json frames
+}
+
+// type frameReader decodes a stream of v1 or v2 frames, transparently
+// inflating compressed frames.
+type frameReader struct {
+	r       io.Reader
+	pending []*frame // frames already decoded from a compressed frame
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: r}
+}
+
+// reads the next frame from the stream.  Returns io.EOF only if the stream
+// ends cleanly on a frame boundary.
+func (f *frameReader) next() (*frame, error) {
+	for len(f.pending) == 0 {
+		fr, err := readFrame(f.r)
+		if err != nil {
+			return nil, err
+		}
+		if fr.kind != frameCompressed {
+			return fr, nil
+		}
+		if err := f.inflate(); err != nil {
+			return nil, err
+		}
+	}
+	fr := f.pending[0]
+	f.pending = f.pending[1:]
+	return fr, nil
+}
+
+// reads the compressed payload following a compressed frame header and
+// decodes every frame inside of it.
+func (f *frameReader) inflate() error {
+	var size uint32
+	if err := binary.Read(f.r, binary.BigEndian, &size); err != nil {
+		return unexpected(err)
+	}
+	z, err := zlib.NewReader(io.LimitReader(f.r, int64(size)))
+	if err != nil {
+		return fmt.Errorf("unable to read compressed frame: %v", err)
+	}
+	raw, err := ioutil.ReadAll(z)
+	if err != nil {
+		return fmt.Errorf("unable to read compressed frame: %v", err)
+	}
+
+	inner := newFrameReader(bytes.NewReader(raw))
+	for {
+		fr, err := inner.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("bad frame in compressed payload: %v", err)
+		}
+		f.pending = append(f.pending, fr)
+	}
+}
+
+// reads a single frame.  For compressed frames, only the header is consumed.
+func readFrame(r io.Reader) (*frame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	fr := &frame{version: header[0], kind: header[1]}
+	if fr.version != '1' && fr.version != '2' {
+		return nil, fmt.Errorf("unknown protocol version %q", fr.version)
+	}
+
+	switch fr.kind {
+	case frameAck:
+		if err := binary.Read(r, binary.BigEndian, &fr.seq); err != nil {
+			return nil, unexpected(err)
+		}
+	case frameWindow:
+		if err := binary.Read(r, binary.BigEndian, &fr.window); err != nil {
+			return nil, unexpected(err)
+		}
+	case frameCompressed:
+	case frameData:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &fr.seq); err != nil {
+			return nil, unexpected(err)
+		}
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, unexpected(err)
+		}
+		fr.fields = make(map[string]interface{})
+		for i := uint32(0); i < count; i++ {
+			k, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			fr.fields[k] = v
+		}
+	case frameJSON:
+		if err := binary.Read(r, binary.BigEndian, &fr.seq); err != nil {
+			return nil, unexpected(err)
+		}
+		raw, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(raw), &fr.fields); err != nil {
+			return nil, fmt.Errorf("unable to decode json frame: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown frame type %q", fr.kind)
+	}
+	return fr, nil
+}
+
+// reads a 32bit length followed by that many bytes.
+func readString(r io.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", unexpected(err)
+	}
+	if n > maxFrameString {
+		return "", fmt.Errorf("frame string of %d bytes is longer than the %d allowed", n, maxFrameString)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", unexpected(err)
+	}
+	return string(b), nil
+}
+
+// a stream that ends in the middle of a frame is an error, not a clean EOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+func testPage() eventPage {
+	return eventPage{
+		&FileEvent{
+			Source: "/var/log/app.log",
+			Offset: 0,
+			Text:   "first line",
+			Fields: map[string]interface{}{"type": "app"},
+		},
+		&FileEvent{
+			Source: "/var/log/app.log",
+			Offset: 11,
+			Text:   "second line",
+			Fields: map[string]interface{}{
+				"type":  "app",
+				"count": 3.0,
+				"debug": true,
+				"tags":  map[string]interface{}{"env": "prod"},
+			},
+		},
+	}
+}
+
+// wraps a compressed page in the window and compressed frames the publisher
+// writes to the socket.
+func testStream(t *testing.T, version int, seq uint32) *bytes.Buffer {
+	page := testPage()
+	var payload, out bytes.Buffer
+	if err := page.compress(version, seq, &payload); err != nil {
+		t.Fatalf("compress failed: %v", err)
+	}
+	v := byte('0' + version)
+	out.Write([]byte{v, frameWindow})
+	binary.Write(&out, binary.BigEndian, uint32(len(page)))
+	out.Write([]byte{v, frameCompressed})
+	binary.Write(&out, binary.BigEndian, uint32(payload.Len()))
+	out.Write(payload.Bytes())
+	return &out
+}
+
+func TestFrameRoundTripV1(t *testing.T) {
+	r := newFrameReader(testStream(t, 1, 7))
+
+	fr, err := r.next()
+	if err != nil {
+		t.Fatalf("unable to read window frame: %v", err)
+	}
+	if fr.version != '1' || fr.kind != frameWindow || fr.window != 2 {
+		t.Fatalf("bad window frame: %+v", fr)
+	}
+
+	for i, e := range testPage() {
+		fr, err := r.next()
+		if err != nil {
+			t.Fatalf("unable to read data frame %d: %v", i, err)
+		}
+		if fr.kind != frameData || fr.seq != 7+uint32(i) {
+			t.Fatalf("bad data frame %d: %+v", i, fr)
+		}
+		if fr.fields["line"] != e.Text || fr.fields["file"] != e.Source {
+			t.Errorf("bad data frame %d payload: %v", i, fr.fields)
+		}
+	}
+
+	if _, err := r.next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestFrameV1FlattensFields(t *testing.T) {
+	r := newFrameReader(testStream(t, 1, 1))
+	r.next()
+	r.next()
+	fr, err := r.next()
+	if err != nil {
+		t.Fatalf("unable to read data frame: %v", err)
+	}
+	expected := map[string]string{
+		"offset": "11",
+		"count":  "3",
+		"debug":  "true",
+		"tags":   `{"env":"prod"}`,
+	}
+	for k, v := range expected {
+		if fr.fields[k] != v {
+			t.Errorf("field %s: expected %q, got %#v", k, v, fr.fields[k])
+		}
+	}
+}
+
+func TestFrameRoundTripV2(t *testing.T) {
+	r := newFrameReader(testStream(t, 2, 1))
+
+	fr, err := r.next()
+	if err != nil {
+		t.Fatalf("unable to read window frame: %v", err)
+	}
+	if fr.version != '2' || fr.kind != frameWindow {
+		t.Fatalf("bad window frame: %+v", fr)
+	}
+	r.next()
+	fr, err = r.next()
+	if err != nil {
+		t.Fatalf("unable to read json frame: %v", err)
+	}
+	if fr.version != '2' || fr.kind != frameJSON || fr.seq != 2 {
+		t.Fatalf("bad json frame: %+v", fr)
+	}
+	if fr.fields["offset"] != 11.0 {
+		t.Errorf("offset should be a number, got %#v", fr.fields["offset"])
+	}
+	if fr.fields["count"] != 3.0 || fr.fields["debug"] != true {
+		t.Errorf("field types not preserved: %v", fr.fields)
+	}
+	tags, ok := fr.fields["tags"].(map[string]interface{})
+	if !ok || tags["env"] != "prod" {
+		t.Errorf("nested field not preserved: %#v", fr.fields["tags"])
+	}
+}
+
+func TestFrameReservedKeys(t *testing.T) {
+	page := eventPage{&FileEvent{
+		Source: "/var/log/app.log",
+		Offset: 11,
+		Text:   "second line",
+		Host:   "web1",
+		Fields: map[string]interface{}{
+			"file":   "other.log",
+			"host":   "web2",
+			"offset": 99,
+			"line":   "not the line",
+			"type":   "app",
+		},
+	}}
+	for _, version := range []int{1, 2} {
+		var payload bytes.Buffer
+		if err := page.compress(version, 1, &payload); err != nil {
+			t.Fatalf("compress failed: %v", err)
+		}
+		var stream bytes.Buffer
+		stream.Write([]byte{byte('0' + version), frameCompressed})
+		binary.Write(&stream, binary.BigEndian, uint32(payload.Len()))
+		stream.Write(payload.Bytes())
+
+		fr, err := newFrameReader(&stream).next()
+		if err != nil {
+			t.Fatalf("v%d: unable to read frame: %v", version, err)
+		}
+		if len(fr.fields) != 5 {
+			t.Errorf("v%d: expected 5 keys, got %v", version, fr.fields)
+		}
+		if fr.fields["file"] != "/var/log/app.log" || fr.fields["host"] != "web1" ||
+			fr.fields["line"] != "second line" || fr.fields["type"] != "app" {
+			t.Errorf("v%d: reserved keys overridden by fields: %v", version, fr.fields)
+		}
+		if fmt.Sprint(fr.fields["offset"]) != "11" {
+			t.Errorf("v%d: expected offset 11, got %#v", version, fr.fields["offset"])
+		}
+	}
+}
+
+func TestFrameAck(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte("2A"))
+	binary.Write(&buf, binary.BigEndian, uint32(1024))
+
+	fr, err := newFrameReader(&buf).next()
+	if err != nil {
+		t.Fatalf("unable to read ack frame: %v", err)
+	}
+	if fr.kind != frameAck || fr.seq != 1024 {
+		t.Errorf("bad ack frame: %+v", fr)
+	}
+}
+
+func TestFrameTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write([]byte("2J"))
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	binary.Write(&buf, binary.BigEndian, uint32(math.MaxUint32))
+
+	if _, err := newFrameReader(&buf).next(); err == nil {
+		t.Errorf("expected an error reading a frame claiming a 4GB payload")
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	b := testStream(t, 2, 1).Bytes()
+	r := newFrameReader(bytes.NewReader(b[:len(b)-4]))
+	r.next()
+	if _, err := r.next(); err == nil {
+		t.Errorf("expected an error reading a truncated compressed frame")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Globs are shell globs as understood by filepath.Match, except that a path
+// element of just ** matches any number of directories, including none.  So
+// /srv/apps/**/*.log matches /srv/apps/web.log and /srv/apps/web/2/out.log.
+
+// splits a path or glob into its elements.  Absolute paths start with an
+// empty element.
+func globSegments(path string) []string {
+	return strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+}
+
+// reports whether path matches the glob.
+func globMatch(glob, path string) bool {
+	return matchSegments(globSegments(glob), globSegments(path), false)
+}
+
+// reports whether dir could hold files matching the glob, at any depth.
+func globContains(glob, dir string) bool {
+	return matchSegments(globSegments(glob), globSegments(dir), true)
+}
+
+// matches the elements of a path against those of a glob.  With prefix, the
+// path only has to match the start of the glob.
+func matchSegments(glob, path []string, prefix bool) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			if prefix {
+				return true
+			}
+			for i := 0; i <= len(path); i++ {
+				if matchSegments(glob[1:], path[i:], false) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return prefix
+		}
+		if ok, _ := filepath.Match(glob[0], path[0]); !ok {
+			return false
+		}
+		glob, path = glob[1:], path[1:]
+	}
+	return len(path) == 0
+}
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// returns the leading directories of a glob that have no wildcards in them.
+func globBase(glob string) string {
+	segments := globSegments(glob)
+	i := 0
+	for i < len(segments)-1 && !hasMeta(segments[i]) {
+		i++
+	}
+	switch base := strings.Join(segments[:i], "/"); {
+	case i == 0:
+		return "."
+	case base == "":
+		return "/"
+	default:
+		return filepath.FromSlash(base)
+	}
+}
+
+// returns the paths matching glob and the directories that could hold more
+// matches, leaving out anything matching exclude.  Globs using ** are matched
+// by walking the directories under their base, which doesn't follow symbolic
+// links to directories.
+func expandGlob(glob string, exclude globList) (matches, dirs []string, err error) {
+	if !strings.Contains(glob, "**") {
+		if matches, err = filepath.Glob(glob); err != nil {
+			return nil, nil, err
+		}
+		// every directory level that may have matching directories added
+		// to it.
+		for p := filepath.Dir(glob); ; p = filepath.Dir(p) {
+			found, _ := filepath.Glob(p)
+			for _, dir := range found {
+				if info, err := os.Stat(dir); err == nil && info.IsDir() {
+					dirs = append(dirs, dir)
+				}
+			}
+			if !hasMeta(p) || p == filepath.Dir(p) {
+				break
+			}
+		}
+		return exclude.filter(matches), exclude.filter(dirs), nil
+	}
+
+	err = filepath.Walk(globBase(glob), func(path string, info os.FileInfo, err error) error {
+		if err != nil || exclude.match(path) {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if !globContains(glob, path) {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, path)
+		}
+		if globMatch(glob, path) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, dirs, err
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, test := range []struct {
+		glob, path string
+		match      bool
+	}{
+		{"/var/log/*.log", "/var/log/syslog.log", true},
+		{"/var/log/*.log", "/var/log/nginx/access.log", false},
+		{"/srv/apps/**/*.log", "/srv/apps/web.log", true},
+		{"/srv/apps/**/*.log", "/srv/apps/web/2/out.log", true},
+		{"/srv/apps/**/*.log", "/srv/web.log", false},
+		{"/srv/**", "/srv/apps/web.log", true},
+		{"**/*.log", "apps/web.log", true},
+		{"/srv/*/logs/**/err", "/srv/web/logs/a/b/err", true},
+		{"/srv/*/logs/**/err", "/srv/web/tmp/a/b/err", false},
+	} {
+		if got := globMatch(test.glob, test.path); got != test.match {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", test.glob, test.path, got, test.match)
+		}
+	}
+
+	for _, test := range []struct {
+		glob, dir string
+		contains  bool
+	}{
+		{"/srv/apps/**/*.log", "/srv/apps/web/2", true},
+		{"/srv/apps/**/*.log", "/srv", true},
+		{"/srv/apps/**/*.log", "/srv/other", false},
+		{"/var/log/*/app.log", "/var/log/web", true},
+		{"/var/log/*/app.log", "/var/log/web/old", false},
+	} {
+		if got := globContains(test.glob, test.dir); got != test.contains {
+			t.Errorf("globContains(%q, %q) = %v, expected %v", test.glob, test.dir, got, test.contains)
+		}
+	}
+}
+
+func TestExpandGlob(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, path := range []string{"a.log", "web/b.log", "web/2/c.log", "web/2/c.txt", "tmp/d.log"} {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+
+	var exclude globList
+	if err := json.Unmarshal([]byte(`["`+filepath.Join(dir, "tmp")+`"]`), &exclude); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	matches, dirs, err := expandGlob(filepath.Join(dir, "**/*.log"), exclude)
+	if err != nil {
+		t.Fatalf("expandGlob failed: %v", err)
+	}
+	rel := func(paths []string) []string {
+		for i, p := range paths {
+			paths[i], _ = filepath.Rel(dir, p)
+		}
+		return paths
+	}
+	if want := []string{"a.log", "web/2/c.log", "web/b.log"}; !reflect.DeepEqual(rel(matches), want) {
+		t.Errorf("expected matches %v, got %v", want, matches)
+	}
+	if want := []string{".", "web", "web/2"}; !reflect.DeepEqual(rel(dirs), want) {
+		t.Errorf("expected dirs %v, got %v", want, dirs)
+	}
+}
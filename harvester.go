@@ -20,6 +20,19 @@ const (
 	h_StartAtEnd
 )
 
+// how long to wait for more of a line without a newline before sending it as
+// it is.  A var so that tests can shorten it.
+var partialLineWait = 10 * time.Second
+
+const (
+	// how often a harvester at the end of its file checks it for new lines.
+	// When the file's directory is watched, a harvester is woken as soon as
+	// the file is written to, and only checks this often in case a write
+	// went unnoticed, e.g. to a file already deleted.
+	pollInterval  = 1 * time.Second
+	watchInterval = 10 * time.Second
+)
+
 // harvester file handle status
 type hfStatus int
 
@@ -33,26 +46,96 @@ const (
 // type Harvester is responsible for tailing a single log file and emitting
 // FileEvents.  A harvester never changes which inode it points to.
 type Harvester struct {
-	Path   string
-	Fields map[string]string
-	join   joinspec
+	Path    string
+	Fields  map[string]interface{}
+	host    string // the host lines came from, if not this one
+	join    joinspec
+	codec   codec
+	extract extractspec
+	include patternList
+	exclude patternList
+	startAt startPosition
+
+	closeInactive time.Duration // how long to keep the file open without new lines
 
 	moved      bool // this is set when the file has been moved by logrotate
 	file       *os.File
+	reader     io.Reader // the file, or its decompressed contents
+	compressed bool      // reader decompresses the file
+	start      int64     // uncompressed offset reading started at, if compressed
 	fi         os.FileInfo
 	lastRead   time.Time
-	out        chan *FileEvent
+	out        fanout
 	lastLine   []byte
 	lastOffset int64
+	lastEnd    int64     // offset just past the bytes of lastLine
+	lastLines  int       // number of lines joined in lastLine
+	lastJoined time.Time // when a line was last added to lastLine
+	joinNext   bool      // the next line is joined to lastLine
+	stop       *stopper  // tells the harvester to stop. may be nil.
+	aborted    bool      // an event was abandoned, so nothing more may be sent
+	watched    bool      // the file's directory is watched for writes
+	wake       chan struct{}
+
+	joinMaxLines int
+	joinMaxBytes int
+	joinTimeout  time.Duration
+
+	conf  *FileConfig // the files entry the harvester was started for
+	tail  []byte      // the last bytes read, to recognise a copy of the file by
+	drain bool        // the file is a rotated copy, so stop at its end
+}
 
-	nextPath string
+// returns a harvester for a file matched by one of fileconfig's paths.
+func newHarvester(path string, fileconfig *FileConfig, out fanout, stop *stopper) *Harvester {
+	return &Harvester{
+		Path:    path,
+		conf:    fileconfig,
+		Fields:  fileconfig.Fields,
+		join:    fileconfig.Join,
+		codec:   fileconfig.Codec,
+		extract: fileconfig.Extract,
+		include: fileconfig.Include,
+		exclude: fileconfig.Exclude,
+		startAt: fileconfig.StartPosition,
+		out:     out,
+		stop:    stop,
+
+		closeInactive: time.Duration(fileconfig.CloseInactive) * time.Second,
+
+		joinMaxLines: fileconfig.JoinMaxLines,
+		joinMaxBytes: fileconfig.JoinMaxBytes,
+		joinTimeout:  time.Duration(fileconfig.JoinTimeout) * time.Second,
+	}
+}
+
+// returns the harvester's path, and whether its file was moved from the path
+// it was found at.  The registry changes both when the file is renamed, so
+// they're read under its lock.
+func (h *Harvester) location() (string, bool) {
+	if registry == nil {
+		return h.Path, h.moved
+	}
+	registry.RLock()
+	defer registry.RUnlock()
+	return h.Path, h.moved
+}
+
+func (h *Harvester) path() string {
+	path, _ := h.location()
+	return path
+}
+
+// reports whether the harvester has been told to stop.
+func (h *Harvester) stopped() bool {
+	return h.stop.stopped()
 }
 
 func (h *Harvester) MarshalJSON() ([]byte, error) {
 	type t struct {
-		Path   string            `json:"path"`
-		Id     fileId            `json:"id"`
-		Fields map[string]string `json:"fields"`
+		Path   string                 `json:"path"`
+		Id     fileId                 `json:"id"`
+		Fields map[string]interface{} `json:"fields"`
 	}
 	id, err := h.fileId()
 	if err != nil {
@@ -66,25 +149,63 @@ func (h *Harvester) MarshalJSON() ([]byte, error) {
 	return json.Marshal(v)
 }
 
+// wakes the harvester if it is waiting for its file to be written to.
+func (h *Harvester) notify() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// returns how long to wait at the end of the file before reading it again.
+// The wait is cut short by any of the deadlines.
+func (h *Harvester) eofWait(deadlines ...time.Time) time.Duration {
+	wait := pollInterval
+	if h.watched {
+		wait = watchInterval
+	}
+	now := time.Now()
+	for _, d := range deadlines {
+		if d.IsZero() {
+			continue
+		}
+		if until := d.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
 // readlines reads lines from the harvester's existing file handle.  readlines
-// does not open or seek a file on its own.
+// does not open or seek a file on its own.  At the end of the file it waits to
+// be told the file was written to, or polls it if its directory can't be
+// watched.
 func (h *Harvester) readlines(timeout time.Duration) {
+	h.wake = make(chan struct{}, 1)
+	h.watched = h.path() != "-" && !h.compressed && watchDir(filepath.Dir(h.path()))
 	if err := registry.register(h); err != nil {
 		log.Printf("readlines unable to register: %v", err)
 		return
 	}
 	defer registry.unregister(h)
+	defer h.flushJoined()
 
-	r := bufio.NewReader(h.file)
+	r := bufio.NewReader(h.reader)
 
 	offset, err := h.fileOffset()
 	if err != nil {
 		log.Printf("unable to read file offset in readlines: %v", err)
 		return
 	}
+	if offset > 0 && !h.compressed && h.path() != "-" {
+		h.loadTail(offset)
+	}
 
 	var fragment bytes.Buffer
-	eof_attempts := 0
+	var partialSince time.Time // when the partial line in fragment was first read
 
 	type Newline int8
 	const (
@@ -104,60 +225,103 @@ func (h *Harvester) readlines(timeout time.Duration) {
 			}
 
 			if hasNewline == YES {
-				h.emit(fragment.Bytes(), offset)
+				h.emit(fragment.Bytes(), offset, offset+int64(fragment.Len()))
 			} else {
-				h.emit(fragment.Bytes(), offset-1)
+				h.emit(fragment.Bytes(), offset-1, offset+int64(fragment.Len()))
 			}
 			offset += int64(fragment.Len())
+			h.remember(fragment.Bytes())
 			fragment.Reset()
-			eof_attempts = 0
+			partialSince = time.Time{}
 		}
 	}
 	defer purgeFragment(UNKNOWN)
 
+	timer := time.NewTimer(pollInterval)
+	timer.Stop()
+	h.lastRead = time.Now()
 	for {
-		h.lastRead = time.Now()
 		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			h.lastRead = time.Now()
+		}
 		preFragLen := fragment.Len()
 		fragment.Write(line)
 		switch err {
 		case io.EOF:
-			eof_attempts++
-
+			if h.compressed || h.drain {
+				// compressed files and rotated copies are never appended to.
+				log.Printf("harvester finished rotated file %s", h.path())
+				return
+			}
 			if len(line) > 0 {
 				if preFragLen == 0 {
-					// Since the buffer was empty, reset attempts so we get a full 10s
-					eof_attempts = 0
+					// give the rest of the line a full partialLineWait.
+					partialSince = time.Now()
 				}
-
-				log.Printf("harvester hit EOF in %s with line. EOF attempt: %d", h.Path, eof_attempts)
-			}
-			if rewound, err := h.autoRewind(offset, line); err != nil {
-				log.Printf("harvester for file %s stopping: %v", h.Path, err)
-				return
-			} else if rewound {
-				log.Printf("harvester for file %s rewound", h.Path)
-				offset = 0
+				log.Printf("harvester hit EOF in %s with line", h.path())
 			}
 			if time.Since(h.lastRead) > timeout {
-				log.Printf("harvester timed out: %s", h.Path)
+				// leave any partial line to be read whole when the file
+				// is reopened.
+				log.Printf("harvester closing inactive file %s at offset %d", h.path(), offset)
+				fragment.Reset()
+				if info, err := h.file.Stat(); err == nil && h.path() != "-" {
+					registry.deactivate(h.path(), offset, info.Size(), append([]byte(nil), h.tail...))
+				}
 				return
 			}
 
-			if eof_attempts >= 10 {
-				if fragment.Len() > 0 {
-					// Just emit what we have.
-					// The offset is reduced by 1 because there's no trailing
-					// '\n' character in this case.
-					log.Printf("harvester purging buffer without newline in %s after %d attempts", h.Path, eof_attempts)
-					purgeFragment(NO)
+			if fragment.Len() > 0 && time.Since(partialSince) >= partialLineWait {
+				// Just emit what we have.
+				// The offset is reduced by 1 because there's no trailing
+				// '\n' character in this case.
+				log.Printf("harvester purging buffer without newline in %s after %v", h.path(), partialLineWait)
+				purgeFragment(NO)
+			}
+			if len(h.lastLine) > 0 && time.Since(h.lastJoined) >= h.joinTimeout {
+				// nothing more has arrived to join, so send what we have.
+				h.flushJoined()
+			}
+
+			var partialDeadline, joinDeadline time.Time
+			if fragment.Len() > 0 {
+				partialDeadline = partialSince.Add(partialLineWait)
+			}
+			if len(h.lastLine) > 0 {
+				joinDeadline = h.lastJoined.Add(h.joinTimeout)
+			}
+			// timer has always fired or been drained by now.
+			timer.Reset(h.eofWait(partialDeadline, joinDeadline, h.lastRead.Add(timeout)))
+			select {
+			case <-h.stop.stopping():
+				log.Printf("harvester for file %s stopping", h.path())
+				return
+			case <-h.wake:
+				if !timer.Stop() {
+					<-timer.C
 				}
+			case <-timer.C:
+			}
 
-				eof_attempts = 0
+			// look for truncation before reading on, so that what has been
+			// written since isn't read as if it followed what we read.
+			if rewound, err := h.autoRewind(offset); err != nil {
+				log.Printf("harvester for file %s stopping: %v", h.path(), err)
+				return
+			} else if rewound {
+				// the rest of a partial line is in the file's copy, if
+				// anywhere.
+				log.Printf("harvester for file %s rewound", h.path())
+				offset = 0
+				fragment.Reset()
 			}
-			time.Sleep(1 * time.Second)
 		case nil:
 			purgeFragment(YES)
+			if h.stopped() {
+				log.Printf("harvester for file %s stopping", h.path())
+				return
+			}
 		default:
 			log.Printf("unable to read line in harvester: %v", err)
 			return
@@ -167,55 +331,121 @@ func (h *Harvester) readlines(timeout time.Duration) {
 
 // the event method takes a line of text found at a byte offset in the
 // harvester's current file and wraps it in a *FileEvent object, adding some
-// file-level context to the FileEvent.
+// file-level context to the FileEvent, and any fields the codec and extract
+// patterns find in the line.  Returns nil if the line is filtered out or the
+// codec drops it.
 func (h *Harvester) event(text string, offset int64) *FileEvent {
+	text = strings.TrimSpace(text)
+	if !h.wanted(text) {
+		droppedLines.Add(h.path(), 1)
+		return nil
+	}
+
+	fields := make(map[string]interface{}, len(h.Fields)+1)
+	for k, v := range h.Fields {
+		fields[k] = v
+	}
+	path, moved := h.location()
 	e := &FileEvent{
-		Source:   h.Path,
+		Source:   path,
 		Offset:   offset,
-		Text:     strings.TrimSpace(text),
-		Fields:   h.Fields,
-		Rotated:  h.moved,
+		Text:     text,
+		Host:     h.host,
+		Fields:   fields,
+		Rotated:  moved,
 		fileinfo: h.fi,
 	}
-	if h.moved {
+	if moved {
 		e.Fields["rotated"] = "true"
 	} else {
 		e.Fields["rotated"] = "false"
 	}
+	if !h.codec.decode(e) {
+		droppedLines.Add(h.path(), 1)
+		return nil
+	}
+	h.extract.apply(e)
 	return e
 }
 
-func (h *Harvester) emit(line []byte, offset int64) {
+// sends an event to the harvester's network groups, unless it was dropped.
+// Once an event has been abandoned, later ones are dropped too, so that the
+// progress file never records an offset past a line that wasn't sent.
+func (h *Harvester) send(e *FileEvent) {
+	if e == nil || h.aborted {
+		return
+	}
+	if !h.out.send(e, h.stop.aborting()) {
+		log.Printf("harvester for file %s aborted at offset %d", h.path(), e.Offset)
+		h.aborted = true
+	}
+}
+
+// handles a line read from the file.  offset is the offset sent with its
+// event, and end is the offset just past the line's bytes.
+func (h *Harvester) emit(line []byte, offset, end int64) {
 	if h.join == nil {
-		h.out <- h.event(string(line[:]), offset)
+		h.send(h.event(string(line[:]), offset).ending(line, end))
 		return
 	}
-	for _, v := range h.join {
-		if v.with == "previous" {
-			if v.match != nil {
-				if v.match.Match(line) {
-					h.lastLine = append(h.lastLine, line...)
-					return
-				}
-			}
-			if v.not != nil {
-				if !v.not.Match(line) {
-					h.lastLine = append(h.lastLine, line...)
-					return
-				}
-			}
-		}
+
+	joined := h.joinNext || h.join.joins(join_Previous, line)
+	if joined && len(h.lastLine) > 0 && !h.joinFull(line) {
+		h.lastLine = append(h.lastLine, line...)
+		h.lastLines++
+		h.lastEnd = end
+	} else {
+		h.flushJoined()
+		h.lastLine = make([]byte, len(line))
+		copy(h.lastLine, line)
+		h.lastOffset = offset
+		h.lastEnd = end
+		h.lastLines = 1
 	}
+	h.lastJoined = time.Now()
 
+	// without "previous" joins, an event is complete as soon as a line
+	// doesn't ask for the next one.
+	h.joinNext = h.join.joins(join_Next, line)
+	if !h.joinNext && !h.join.has(join_Previous) {
+		h.flushJoined()
+	}
+}
+
+// reports whether joining line to lastLine would go over the harvester's
+// limits.
+func (h *Harvester) joinFull(line []byte) bool {
+	if h.joinMaxLines > 0 && h.lastLines >= h.joinMaxLines {
+		return true
+	}
+	return h.joinMaxBytes > 0 && len(h.lastLine)+len(line) > h.joinMaxBytes
+}
+
+// sends the line being joined, if any, since no more lines will be joined to
+// it.
+func (h *Harvester) flushJoined() {
 	if len(h.lastLine) > 0 {
-		h.out <- h.event(string(h.lastLine[:]), h.lastOffset)
+		h.send(h.event(string(h.lastLine[:]), h.lastOffset).ending(h.lastLine, h.lastEnd))
 	}
-	h.lastLine = make([]byte, len(line))
-        copy(h.lastLine, line)
-	h.lastOffset = offset
+	h.lastLine = nil
+	h.lastLines = 0
+	h.joinNext = false
 }
 
+// reports whether a line passes the harvester's include and exclude filters.
+func (h *Harvester) wanted(line string) bool {
+	if len(h.include) > 0 && !h.include.match(line) {
+		return false
+	}
+	return !h.exclude.match(line)
+}
+
+// returns the offset reading starts from.  Offsets in compressed files are
+// offsets in their decompressed contents.
 func (h *Harvester) fileOffset() (int64, error) {
+	if h.compressed {
+		return h.start, nil
+	}
 	return h.file.Seek(0, os.SEEK_CUR)
 }
 
@@ -227,40 +457,64 @@ func (h *Harvester) fileId() (fileId, error) {
 }
 
 func (h *Harvester) Harvest(offset int64, opt int) {
-	defer log.Printf("harvester done reading file %s", h.Path)
-	watchDir(filepath.Dir(h.Path))
-	log.Printf("Starting harvester: %s\n", h.Path)
+	defer log.Printf("harvester done reading file %s", h.path())
+	watchDir(filepath.Dir(h.path()))
+	log.Printf("Starting harvester: %s\n", h.path())
+
+	if !h.acquireSlot() {
+		return
+	}
+	defer releaseSlot()
 
-	h.open(offset, opt)
+	if h.open(offset, opt) == nil {
+		return
+	}
 	defer h.file.Close()
 
-	h.readlines(24 * time.Hour)
+	h.readlines(h.inactiveTimeout())
 }
 
-func (h *Harvester) resume(offset int64, line []byte) {
-	defer log.Printf("harvester done reading file %s", h.Path)
-	log.Printf("trying to resume %s at offset %d", h.Path, offset)
-	if h.Path == "-" {
-		log.Printf("illegal attempt to resume stdin at offset %d", offset)
-		return
+// returns how long the harvester keeps its file open without new lines.
+func (h *Harvester) inactiveTimeout() time.Duration {
+	if h.closeInactive == 0 {
+		return 24 * time.Hour
 	}
+	return h.closeInactive
+}
 
-	h.open(offset, 0)
-	defer h.file.Close()
+// limits the number of harvesters with open files, if -max-open-harvesters
+// is set.
+var openSlots chan struct{}
 
-	_, err := h.file.ReadAt(line, offset-int64(len(line)))
-	if err != nil {
-		log.Printf("couldn't read resume line: %v", err)
-		return
+// waits for a slot to open a file in.  Returns false if the harvester is told
+// to stop first.
+func (h *Harvester) acquireSlot() bool {
+	if openSlots == nil {
+		return true
+	}
+	select {
+	case openSlots <- struct{}{}:
+		return true
+	default:
 	}
-	if len(line) == 0 {
-		h.readlines(24 * time.Hour)
+	log.Printf("harvester for %s waiting for one of %d open file slots", h.path(), cap(openSlots))
+	select {
+	case openSlots <- struct{}{}:
+		return true
+	case <-h.stop.stopping():
+		return false
+	}
+}
+
+func releaseSlot() {
+	if openSlots != nil {
+		<-openSlots
 	}
 }
 
 // checks to see if the file has been truncated, and if so, rewinds the file
 // handle.
-func (h *Harvester) autoRewind(offset int64, line []byte) (bool, error) {
+func (h *Harvester) autoRewind(offset int64) (bool, error) {
 	s, err := h.status(offset)
 	switch s {
 	case hf_Err:
@@ -268,14 +522,13 @@ func (h *Harvester) autoRewind(offset int64, line []byte) (bool, error) {
 	case hf_Ok:
 		return false, nil
 	case hf_Trunc:
-		if h.nextPath != "" {
-			newh := Harvester{Path: h.nextPath, Fields: h.Fields, out: h.out}
-			go newh.resume(offset, line)
-			h.nextPath = ""
+		if path := h.findCopy(offset); path != "" {
+			h.readCopy(path, offset)
 		}
+		h.tail = nil
 		return true, h.rewind()
 	case hf_Gone:
-		return false, fmt.Errorf("file is gone: %s", h.Path)
+		return false, fmt.Errorf("file is gone: %s", h.path())
 	default:
 		return false, fmt.Errorf("unknown harvester file status: %v", s)
 	}
@@ -297,7 +550,12 @@ func (h *Harvester) status(offset int64) (hfStatus, error) {
 		}
 	}
 	if info.Size() < offset {
-		log.Printf("file %s is at offset %d but size is %d", h.Path, offset, info.Size())
+		log.Printf("file %s is at offset %d but size is %d", h.path(), offset, info.Size())
+		return hf_Trunc, nil
+	}
+	if h.rewritten(offset) {
+		// truncated, and written past our offset again since.
+		log.Printf("file %s no longer has what we read before offset %d", h.path(), offset)
 		return hf_Trunc, nil
 	}
 	return hf_Ok, nil
@@ -306,41 +564,62 @@ func (h *Harvester) status(offset int64) (hfStatus, error) {
 func (h *Harvester) rewind() error {
 	_, err := h.file.Seek(0, os.SEEK_SET)
 	if err == nil {
-		log.Printf("rewind %s", h.Path)
+		log.Printf("rewind %s", h.path())
 	}
 	return err
 }
 
 func (h *Harvester) open(offset int64, opt int) *os.File {
 	// Special handling that "-" means to read from standard input
-	if h.Path == "-" {
+	if h.path() == "-" {
 		h.file = os.Stdin
+		h.reader = h.file
 		return h.file
 	}
 
 	for {
 		var err error
-		h.file, err = os.Open(h.Path)
+		h.file, err = os.Open(h.path())
 
 		if err != nil {
 			// retry on failure.
-			log.Printf("Failed opening stupid file %s: %s\n", h.Path, err)
-			time.Sleep(5 * time.Second)
+			log.Printf("Failed opening stupid file %s: %s\n", h.path(), err)
+			select {
+			case <-h.stop.stopping():
+				return nil
+			case <-time.After(5 * time.Second):
+			}
 		} else {
 			break
 		}
 	}
 
+	h.reader = h.file
+	if !h.openCompressed(offset, opt) {
+		h.file.Close()
+		return nil
+	}
+
 	// TODO(sissel): Only seek if the file is a file, not a pipe or socket.
-	if offset > 0 {
+	if h.compressed {
+		// openCompressed has already skipped to the offset.
+	} else if offset > 0 {
 		h.file.Seek(offset, os.SEEK_SET)
-		log.Printf("reading from %d: %s", offset, h.Path)
-	} else if options.FromBeginning || opt&h_Rewind > 0 {
+		log.Printf("reading from %d: %s", offset, h.path())
+	} else if h.startAt.fromBeginning() || opt&h_Rewind > 0 {
 		h.file.Seek(0, os.SEEK_SET)
-		log.Printf("reading from beginning: %s", h.Path)
+		log.Printf("reading from beginning: %s", h.path())
+	} else if h.startAt.where == start_TailLines {
+		offset, err := tailOffset(h.file, h.startAt.lines)
+		if err != nil {
+			log.Printf("unable to find the last %d lines, reading from end: %v", h.startAt.lines, err)
+			offset, _ = h.file.Seek(0, os.SEEK_END)
+		}
+		h.file.Seek(offset, os.SEEK_SET)
+		log.Printf("reading last %d lines from %d: %s", h.startAt.lines, offset, h.path())
 	} else {
 		h.file.Seek(0, os.SEEK_END)
-		log.Printf("reading from end: %s", h.Path)
+		log.Printf("reading from end: %s", h.path())
 	}
 
 	var err error
@@ -351,3 +630,76 @@ func (h *Harvester) open(offset int64, opt int) *os.File {
 
 	return h.file
 }
+
+// returns the offset at which the last n lines of f start.  A last line
+// without a trailing newline counts as a line.
+func tailOffset(f *os.File, n int) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := fi.Size()
+	if n <= 0 {
+		return end, nil
+	}
+	last := make([]byte, 1)
+	if end > 0 {
+		if _, err := f.ReadAt(last, end-1); err != nil {
+			return 0, err
+		}
+		if last[0] == '\n' {
+			end--
+		}
+	}
+
+	buf := make([]byte, 4096)
+	found := 0
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] == '\n' {
+				found++
+				if found == n {
+					return start + int64(i) + 1, nil
+				}
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// checks whether the opened file is compressed, and if so, reads it through
+// a decompressor, skipping to the uncompressed offset.  Since a compressed
+// file never grows, it is only read if asked to read from the beginning or an
+// offset.  Returns false if the file shouldn't be read.
+func (h *Harvester) openCompressed(offset int64, opt int) bool {
+	z, err := decompressor(h.file)
+	if err != nil {
+		log.Printf("unable to open compressed file %s: %v", h.path(), err)
+		return false
+	}
+	if z == nil {
+		return true
+	}
+	if offset == 0 && !h.startAt.fromBeginning() && opt&h_Rewind == 0 {
+		log.Printf("skipping compressed file, since we're reading from the end: %s", h.path())
+		return false
+	}
+	if err := skip(z, offset); err != nil {
+		log.Printf("unable to skip to offset %d in compressed file %s: %v", offset, h.path(), err)
+		return false
+	}
+	h.reader = z
+	h.compressed = true
+	h.start = offset
+	log.Printf("reading compressed file from %d: %s", offset, h.path())
+	return true
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// feeds lines to a harvester with the given join config, returning the text
+// of the events it sends.
+func joinLines(t *testing.T, conf string, lines ...string) []string {
+	var f FileConfig
+	if err := json.Unmarshal([]byte(conf), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	c := make(chan *FileEvent, len(lines)+1)
+	h := newHarvester("/var/log/app.log", &f, fanout{c}, nil)
+	var offset int64
+	for _, line := range lines {
+		h.emit([]byte(line+"\n"), offset, offset+int64(len(line)+1))
+		offset += int64(len(line) + 1)
+	}
+	var sent []string
+	for len(c) > 0 {
+		sent = append(sent, (<-c).Text)
+	}
+	h.flushJoined()
+	for len(c) > 0 {
+		sent = append(sent, "flushed: "+(<-c).Text)
+	}
+	return sent
+}
+
+func checkEvents(t *testing.T, got []string, want ...string) {
+	if len(got) != len(want) {
+		t.Fatalf("got events %q, expected %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("event %d is %q, expected %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestJoinPrevious(t *testing.T) {
+	got := joinLines(t, `{"join": [{"match": "^\\s", "with": "previous"}]}`,
+		"panic: oops", "  at main()", "  at init()", "next")
+	checkEvents(t, got, "panic: oops\n  at main()\n  at init()", "flushed: next")
+}
+
+func TestJoinNext(t *testing.T) {
+	got := joinLines(t, `{"join": [{"match": "\\\\$", "with": "next"}]}`,
+		"one \\", "two \\", "three", "four")
+	checkEvents(t, got, "one \\\ntwo \\\nthree", "four")
+}
+
+func TestJoinLimits(t *testing.T) {
+	got := joinLines(t, `{"join": [{"match": "^\\s", "with": "previous"}], "join_max_lines": 2}`,
+		"panic: oops", "  at main()", "  at init()", "  at start()")
+	checkEvents(t, got, "panic: oops\n  at main()", "flushed: at init()\n  at start()")
+
+	got = joinLines(t, `{"join": [{"match": "^\\s", "with": "previous"}], "join_max_bytes": 30}`,
+		"panic: oops", "  at main()", "  at init()")
+	checkEvents(t, got, "panic: oops\n  at main()", "flushed: at init()")
+}
+
+func TestCompressedFiles(t *testing.T) {
+	if registry == nil {
+		registry = newRegistry(&Config{})
+	}
+	dir, err := ioutil.TempDir("", "lumberjack")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	z := gzip.NewWriter(&gz)
+	z.Write([]byte("first line\nsecond line\nthird line\n"))
+	z.Close()
+	path := filepath.Join(dir, "app.log.1.gz")
+	if err := ioutil.WriteFile(path, gz.Bytes(), 0644); err != nil {
+		t.Fatalf("unable to write compressed file: %v", err)
+	}
+
+	c := make(chan *FileEvent, 4)
+	h := newHarvester(path, &FileConfig{}, fanout{c}, nil)
+	if h.open(11, 0) == nil {
+		t.Fatalf("compressed file not opened")
+	}
+	h.readlines(time.Second)
+	h.file.Close()
+
+	for _, want := range []FileEvent{{Text: "second line", Offset: 11}, {Text: "third line", Offset: 23}} {
+		if len(c) == 0 {
+			t.Fatalf("missing event for %q", want.Text)
+		}
+		e := <-c
+		if e.Text != want.Text || e.Offset != want.Offset {
+			t.Errorf("got event %q at %d, expected %q at %d", e.Text, e.Offset, want.Text, want.Offset)
+		}
+	}
+	if len(c) != 0 {
+		t.Errorf("unexpected event %q", (<-c).Text)
+	}
+
+	h = newHarvester(path, &FileConfig{}, fanout{c}, nil)
+	if h.open(0, 0) != nil {
+		t.Errorf("compressed file read from the end")
+	}
+}
+
+func TestStartPosition(t *testing.T) {
+	var f FileConfig
+	if err := json.Unmarshal([]byte(`{"paths": ["/var/log/app.log"], "start_position": "tail_lines:2"}`), &f); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if f.StartPosition.where != start_TailLines || f.StartPosition.lines != 2 {
+		t.Errorf("bad start position: %+v", f.StartPosition)
+	}
+	if f.IgnoreOlder != 24*60*60 || f.ScanInterval != 10 {
+		t.Errorf("bad defaults: ignore_older %d, scan_interval %d", f.IgnoreOlder, f.ScanInterval)
+	}
+	if err := json.Unmarshal([]byte(`{"paths": ["/var/log/app.log"], "ignore_older": 0}`), &f); err != nil || f.IgnoreOlder != 0 {
+		t.Errorf("expected ignore_older 0 to turn the cutoff off, got %d (%v)", f.IgnoreOlder, err)
+	}
+	for _, key := range []string{"ignore_older", "scan_interval", "close_inactive"} {
+		if err := json.Unmarshal([]byte(`{"`+key+`": -1}`), &f); err == nil {
+			t.Errorf("negative %s accepted", key)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"start_position": "middle"}`), &f); err == nil {
+		t.Errorf("unknown start position accepted")
+	}
+}
+
+func TestTailOffset(t *testing.T) {
+	f, err := ioutil.TempFile("", "lumberjack")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, tc := range []struct {
+		contents string
+		lines    int
+		offset   int64
+	}{
+		{"one\ntwo\nthree\n", 2, 4},
+		{"one\ntwo\nthree", 2, 4},
+		{"one\ntwo\nthree\n", 5, 0},
+		{"one\ntwo\nthree\n", 0, 14},
+		{"", 3, 0},
+	} {
+		f.Truncate(0)
+		f.WriteAt([]byte(tc.contents), 0)
+		offset, err := tailOffset(f, tc.lines)
+		if err != nil || offset != tc.offset {
+			t.Errorf("last %d lines of %q start at %d (%v), expected %d", tc.lines, tc.contents, offset, err, tc.offset)
+		}
+	}
+}
+
+func TestCloseInactive(t *testing.T) {
+	if registry == nil {
+		registry = newRegistry(&Config{})
+	}
+	f, err := ioutil.TempFile("", "lumberjack")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write([]byte("first line\npartial"))
+
+	c := make(chan *FileEvent, 4)
+	h := newHarvester(f.Name(), &FileConfig{}, fanout{c}, nil)
+	h.open(0, h_Rewind)
+	h.readlines(500 * time.Millisecond)
+	h.file.Close()
+
+	if len(c) != 1 || (<-c).Text != "first line" {
+		t.Fatalf("expected only the complete line to be sent")
+	}
+	if _, ok := registry.reopen(f.Name(), 18); ok {
+		t.Errorf("unchanged file reopened")
+	}
+	f.Write([]byte(" line\n"))
+	offset, ok := registry.reopen(f.Name(), 24)
+	if !ok || offset != 11 {
+		t.Errorf("file that grew reopened at %d (%v), expected 11", offset, ok)
+	}
+	if _, ok := registry.reopen(f.Name(), 30); ok {
+		t.Errorf("reopened file still inactive")
+	}
+
+	// truncated and written past its old size before we looked again.
+	registry.deactivate(f.Name(), 11, 24, []byte("first line\n"))
+	f.Truncate(0)
+	f.WriteAt([]byte("something else entirely\nand more\n"), 0)
+	if offset, ok := registry.reopen(f.Name(), 34); !ok || offset != 0 {
+		t.Errorf("rewritten file reopened at %d (%v), expected 0", offset, ok)
+	}
+}
+
+func TestWakeOnWrite(t *testing.T) {
+	startWatching(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	defer f.Close()
+	f.Write([]byte("first\n"))
+
+	c := make(chan *FileEvent, 4)
+	s := newStopper()
+	h := newHarvester(path, &FileConfig{}, fanout{c}, s)
+	h.open(0, h_Rewind)
+	defer h.file.Close()
+	s.spawn(func() { h.readlines(time.Minute) })
+	defer s.stop(time.Second)
+
+	if e := <-c; e.Text != "first" {
+		t.Fatalf("expected first line, got %q", e.Text)
+	}
+	time.Sleep(100 * time.Millisecond)
+	f.Write([]byte("second\n"))
+	select {
+	case e := <-c:
+		if e.Text != "second" {
+			t.Errorf("expected second line, got %q", e.Text)
+		}
+	case <-time.After(pollInterval / 2):
+		t.Errorf("harvester wasn't woken by the write")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// splits an input's listen address, e.g. udp://127.0.0.1:514 or
+// unixgram:///dev/log, into a network and address for the net package.
+func parseListen(listen string) (string, string, error) {
+	parts := strings.SplitN(listen, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("bad listen address: %s", listen)
+	}
+	switch parts[0] {
+	case "tcp", "udp", "unix", "unixgram":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("unsupported listen network %s in %s", parts[0], listen)
+}
+
+// listens on the local socket given by an input's listen address, and sends
+// every line received to the input's network groups.  The event's file is the
+// listen address, and its host is the address of the sender.  Runs until stop
+// is stopped.
+func Listen(input FileConfig, netconf NetworkConfig, stop *stopper) {
+	out := netconf.EventChans(input.Dest)
+	if out == nil {
+		log.Printf("ERROR unable to start input %s: no event channel for %v", input.Listen, input.Dest)
+		return
+	}
+	network, addr, err := parseListen(input.Listen)
+	if err != nil {
+		log.Printf("ERROR unable to start input: %v", err)
+		return
+	}
+	if network == "unix" || network == "unixgram" {
+		// a socket left behind by an earlier run would stop us binding, but
+		// anything else at the path isn't ours to remove.
+		if info, err := os.Lstat(addr); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				log.Printf("ERROR unable to start input %s: %s exists and isn't a socket", input.Listen, addr)
+				return
+			}
+			os.Remove(addr)
+		}
+	}
+
+	log.Printf("input listening on %s", input.Listen)
+	defer log.Printf("input on %s stopped", input.Listen)
+	switch network {
+	case "tcp", "unix":
+		listenStream(network, addr, &input, out, stop)
+	default:
+		listenPacket(network, addr, &input, out, stop)
+	}
+}
+
+// accepts connections, reading lines from each one until it is closed.
+func listenStream(network, addr string, input *FileConfig, out fanout, stop *stopper) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		log.Printf("ERROR unable to listen on %s: %v", input.Listen, err)
+		return
+	}
+	defer removeSocket(network, addr)()
+	go func() {
+		<-stop.stopping()
+		l.Close()
+	}()
+
+	var retry backoff
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// errors such as running out of file descriptors are retried.
+			if stop.stopped() {
+				return
+			}
+			log.Printf("error accepting connection on %s: %v; retrying in %v", input.Listen, err, retry.next())
+			if !retry.wait(stop) {
+				return
+			}
+			continue
+		}
+		retry = 0
+		h := newHarvester(input.Listen, input, out, stop)
+		h.host = peerHost(conn.RemoteAddr())
+		stop.spawn(func() { h.readConn(conn) })
+	}
+}
+
+// reads lines from a connection until it is closed, or we're told to stop.
+func (h *Harvester) readConn(conn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-h.stop.stopping():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer conn.Close()
+	defer h.flushJoined()
+
+	r := bufio.NewReader(conn)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			h.emit(line, offset, offset+int64(len(line)))
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if !h.stopped() {
+				log.Printf("unable to read from %s on %s: %v", h.host, h.path(), err)
+			}
+			return
+		}
+	}
+}
+
+// reads datagrams, sending every line in each one.  Lines aren't joined,
+// since datagrams from different senders are interleaved.
+func listenPacket(network, addr string, input *FileConfig, out fanout, stop *stopper) {
+	c, err := net.ListenPacket(network, addr)
+	if err != nil {
+		log.Printf("ERROR unable to listen on %s: %v", input.Listen, err)
+		return
+	}
+	defer removeSocket(network, addr)()
+	go func() {
+		<-stop.stopping()
+		c.Close()
+	}()
+
+	h := newHarvester(input.Listen, input, out, stop)
+	h.join = nil
+	buf := make([]byte, 64<<10)
+	var retry backoff
+	for {
+		n, from, err := c.ReadFrom(buf)
+		if err != nil {
+			if stop.stopped() {
+				return
+			}
+			log.Printf("unable to read from %s: %v; retrying in %v", input.Listen, err, retry.next())
+			if !retry.wait(stop) {
+				return
+			}
+			continue
+		}
+		retry = 0
+		h.host = peerHost(from)
+		for _, line := range bytes.Split(bytes.TrimRight(buf[:n], "\n"), []byte("\n")) {
+			if len(line) > 0 {
+				h.emit(line, 0, 0)
+			}
+		}
+	}
+}
+
+// type backoff is how long an input waits before trying again after an
+// error, doubling from 5ms up to a second as the errors continue, as net/http
+// does after failing to accept.  The zero value is ready to use.
+type backoff time.Duration
+
+// lengthens the wait, and returns it.
+func (b *backoff) next() time.Duration {
+	switch {
+	case *b == 0:
+		*b = backoff(5 * time.Millisecond)
+	case *b < backoff(time.Second/2):
+		*b *= 2
+	default:
+		*b = backoff(time.Second)
+	}
+	return time.Duration(*b)
+}
+
+// waits, returning false if told to stop first.
+func (b backoff) wait(stop *stopper) bool {
+	select {
+	case <-stop.stopping():
+		return false
+	case <-time.After(time.Duration(b)):
+		return true
+	}
+}
+
+// notes the socket file a unix listener was just bound to, and returns a
+// func that removes it on exit, if it's still the same file.
+func removeSocket(network, addr string) func() {
+	if network != "unix" && network != "unixgram" {
+		return func() {}
+	}
+	created, err := os.Lstat(addr)
+	if err != nil {
+		return func() {}
+	}
+	return func() {
+		if info, err := os.Lstat(addr); err == nil && os.SameFile(info, created) {
+			os.Remove(addr)
+		}
+	}
+}
+
+// returns the host part of a sender's address.  Senders on unix sockets are
+// local, and usually unnamed.
+func peerHost(addr net.Addr) string {
+	if addr == nil || addr.String() == "" || addr.String() == "@" {
+		return hostname
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
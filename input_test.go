@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// starts an input listening on addr, returning its event channel.
+func startInput(t *testing.T, listen string) (chan *FileEvent, *stopper) {
+	var input FileConfig
+	if err := json.Unmarshal([]byte(`{"listen": "`+listen+`", "fields": {"type": "syslog"}}`), &input); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	c := make(chan *FileEvent, 4)
+	netconf := NetworkConfig{"default": NetworkGroup{c_events: c}}
+	s := newStopper()
+	s.spawn(func() { Listen(input, netconf, s) })
+	time.Sleep(50 * time.Millisecond)
+	return c, s
+}
+
+func receive(t *testing.T, c chan *FileEvent) *FileEvent {
+	select {
+	case e := <-c:
+		return e
+	case <-time.After(time.Second):
+		t.Fatalf("no event received")
+	}
+	return nil
+}
+
+func TestTCPInput(t *testing.T) {
+	c, s := startInput(t, "tcp://127.0.0.1:45141")
+	defer s.stop(time.Second)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:45141")
+	if err != nil {
+		t.Fatalf("unable to connect to input: %v", err)
+	}
+	conn.Write([]byte("first line\nsecond line\n"))
+	conn.Close()
+
+	for _, want := range []string{"first line", "second line"} {
+		e := receive(t, c)
+		if e.Text != want || e.Source != "tcp://127.0.0.1:45141" || e.host() != "127.0.0.1" {
+			t.Errorf("bad event: %+v", e)
+		}
+		if e.Fields["type"] != "syslog" {
+			t.Errorf("missing fields: %v", e.Fields)
+		}
+	}
+}
+
+func TestUDPInput(t *testing.T) {
+	c, s := startInput(t, "udp://127.0.0.1:45142")
+
+	conn, err := net.Dial("udp", "127.0.0.1:45142")
+	if err != nil {
+		t.Fatalf("unable to connect to input: %v", err)
+	}
+	conn.Write([]byte("<13>a syslog message\n"))
+	conn.Close()
+
+	e := receive(t, c)
+	if e.Text != "<13>a syslog message" || e.host() != "127.0.0.1" {
+		t.Errorf("bad event: %+v", e)
+	}
+	page := eventPage{e}
+	if p := page.progress(); len(p) != 0 {
+		t.Errorf("input events recorded in progress: %v", p)
+	}
+	if !s.stop(time.Second) {
+		t.Errorf("input didn't stop")
+	}
+}
+
+func TestUnixInputSocketFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// a file that isn't a socket is left alone.
+	path := filepath.Join(dir, "log")
+	ioutil.WriteFile(path, []byte("not a socket\n"), 0644)
+	_, s := startInput(t, "unixgram://"+path)
+	s.stop(time.Second)
+	if b, _ := ioutil.ReadFile(path); string(b) != "not a socket\n" {
+		t.Errorf("input replaced a file that wasn't a socket")
+	}
+
+	// a socket left behind is replaced, and ours removed on exit.
+	os.Remove(path)
+	stale, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unable to create socket: %v", err)
+	}
+	stale.Close()
+	c, s := startInput(t, "unixgram://"+path)
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		t.Fatalf("unable to connect to input: %v", err)
+	}
+	conn.Write([]byte("a message\n"))
+	conn.Close()
+	if e := receive(t, c); e.Text != "a message" {
+		t.Errorf("bad event: %+v", e)
+	}
+	s.stop(time.Second)
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the input's socket to be removed on exit, got %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	var got []time.Duration
+	for i := 0; i < 10; i++ {
+		got = append(got, b.next())
+	}
+	want := []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000}
+	for i := range want {
+		if got[i] != want[i]*time.Millisecond {
+			t.Fatalf("expected waits of %v ms, got %v", want, got)
+		}
+	}
+
+	s := newStopper()
+	s.stop(0)
+	if b.wait(s) {
+		t.Errorf("expected wait to return false once stopped")
+	}
+}
@@ -53,15 +53,18 @@ func rmPidfile() {
 
 func awaitSignals() {
 	die, hup := make(chan os.Signal, 1), make(chan os.Signal, 1)
-	signal.Notify(die, os.Interrupt, os.Kill)
+	signal.Notify(die, os.Interrupt, os.Kill, syscall.SIGTERM)
 	signal.Notify(hup, syscall.SIGHUP)
 	for {
 		select {
 		case <-die:
 			log.Println("lumberjack shutting down")
-			shutdown(nil)
+			exit()
 		case <-hup:
 			refreshLogfileHandle()
+			if err := reloadConfig(); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 }
@@ -111,29 +114,50 @@ func shutdown(v interface{}) {
 	log.Fatal(v)
 }
 
-var publisherId = 0
+// exits cleanly, after giving everything read so far a chance to be
+// acknowledged and recorded in the progress file.
+func exit() {
+	if running != nil {
+		running.drain(options.ShutdownTimeout)
+	}
+	for _, fn := range shutdownHandlers {
+		fn()
+	}
+	log.Println("lumberjack stopped")
+	os.Exit(0)
+}
 
-func startPublishers(conf NetworkConfig, out chan eventPage) error {
-	for _, group := range conf {
-		tlsConfig, err := group.TLS()
-		if err != nil {
-			return fmt.Errorf("unable to start publishers: %v", err)
-		}
+var publisherId = 0
 
-		for _, server := range group.Servers {
-			p := &Publisher{
-				id:        publisherId,
-				sequence:  1,
-				addr:      server,
-				tlsConfig: *tlsConfig,
-				timeout:   group.timeout,
-			}
-			log.Printf("TLS config: %v\n", tlsConfig)
-			go p.publish(group.c_pages_unsent, out)
-			publisherId++
+// starts the publishers of a network group, which hand acknowledged pages to
+// out.  The returned dispatcher stops them.
+func startPublishers(group NetworkGroup, out chan eventPage) (*dispatcher, error) {
+	tlsConfig, err := group.TLS()
+	if err != nil {
+		return nil, fmt.Errorf("unable to start publishers for network group %s: %v", group.Name, err)
+	}
+
+	d := newDispatcher(group)
+	for _, server := range group.Servers {
+		p := &Publisher{
+			id:        publisherId,
+			sequence:  1,
+			addr:      server,
+			tlsConfig: *tlsConfig,
+			timeout:   group.timeout,
+			window:    group.Window,
+			version:   group.Protocol,
+			group:     group.c_pages_unsent,
 		}
-	}
-	return nil
+		p.health.maxFailures = group.MaxFailures
+		p.health.cooldown = time.Duration(group.Cooldown) * time.Second
+		d.add(p)
+		log.Printf("TLS config: %v\n", tlsConfig)
+		go p.publish(p.input, out)
+		publisherId++
+	}
+	go d.run(group.c_pages_unsent)
+	return d, nil
 }
 
 func startHttp() {
@@ -183,32 +207,31 @@ func main() {
 		shutdown(err.Error())
 	}
 
-	go cmdListener()
 	registry = newRegistry(config)
+	if options.MaxOpenHarvesters > 0 {
+		openSlots = make(chan struct{}, options.MaxOpenHarvesters)
+	}
 
 	registrar_chan := make(chan eventPage, 1)
 
-	if len(config.Files) == 0 {
-		shutdown("No paths given. What files do you want me to watch?\n")
+	if len(config.Files) == 0 && len(config.Inputs) == 0 {
+		shutdown("No paths or inputs given. What do you want me to watch?\n")
 	}
 
 	go reportFSEvents()
-	// Prospect the globs/paths given on the command line and launch harvesters
-	for _, fileconfig := range config.Files {
-		go Prospect(fileconfig, config.Network)
-	}
-
-	// Harvesters dump events into the spooler.
-	for _, group := range config.Network {
-		group.Spool()
-	}
-
-	if err := startPublishers(config.Network, registrar_chan); err != nil {
+	// Prospect the globs/paths given on the command line and launch
+	// harvesters, which dump events into the spoolers of the network groups
+	// that publish them.
+	running = newPipeline(registrar_chan)
+	if err := running.apply(config); err != nil {
 		shutdown(err)
 	}
 
 	// registrar records last acknowledged positions in all files.
-	go Registrar(registrar_chan)
+	go Registrar(registrar_chan, running.flush)
+	// commands use the running pipeline, so they're only taken once it's
+	// started.
+	go cmdListener()
 	go startHttp()
 	awaitSignals()
 }
@@ -20,6 +20,18 @@ var options struct {
 	NumThreads    int
 	CmdPort       int
 	HttpPort      string
+
+	ShutdownTimeout   time.Duration
+	MaxOpenHarvesters int
+
+	ProgressFlushInterval time.Duration
+	ProgressFlushPages    int
+	ProgressRetention     time.Duration
+
+	QueueDir         string
+	QueueMaxSize     int64
+	QueueSegmentSize int64
+	QueueFsync       string
 }
 
 func init() {
@@ -46,4 +58,22 @@ func init() {
 	flag.IntVar(&options.CmdPort, "cmd-port", 42586, "tcp command port number")
 	flag.StringVar(&options.HttpPort, "http", "",
 		"http port for debug info. No http server is run if this is left off. E.g.: http=:6060")
+	flag.DurationVar(&options.ShutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"Maximum time to wait on shutdown for events already read to be acknowledged")
+	flag.IntVar(&options.MaxOpenHarvesters, "max-open-harvesters", 0,
+		"Maximum number of files to keep open at once. Others wait for a harvester to close. 0 means no limit.")
+	flag.DurationVar(&options.ProgressFlushInterval, "progress-flush-interval", time.Second,
+		"Maximum time acknowledged progress is held in memory before the progress file is written. 0 writes it for every page.")
+	flag.IntVar(&options.ProgressFlushPages, "progress-flush-pages", 100,
+		"Maximum number of acknowledged pages held in memory before the progress file is written")
+	flag.DurationVar(&options.ProgressRetention, "progress-retention", 24*time.Hour,
+		"How long to keep progress for files that no longer exist, or have been replaced, after it last changed")
+	flag.StringVar(&options.QueueDir, "queue-dir", "",
+		"directory for an on-disk queue of unsent events. No disk queue is used if this is left off.")
+	flag.Int64Var(&options.QueueMaxSize, "queue-max-size", 1<<30,
+		"maximum bytes of events to hold in the disk queue, per network group")
+	flag.Int64Var(&options.QueueSegmentSize, "queue-segment-size", 16<<20,
+		"size in bytes of each disk queue file")
+	flag.StringVar(&options.QueueFsync, "queue-fsync", "always",
+		"when to fsync the disk queue: always, segment or never")
 }
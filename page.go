@@ -4,30 +4,60 @@ import (
 	"bytes"
 	"compress/zlib"
 	"fmt"
+	"time"
 )
 
 type eventPage []*FileEvent
 
+// progress returns, for each file in the page, the offset just past its last
+// event's line, and the last bytes of it.  Rotated files are recorded too,
+// under their new names, so that they are finished after a restart.
+// Publishers hand the registrar acknowledged runs of events in order, so this
+// is the watermark of what logstash has confirmed for each file.
 func (p *eventPage) progress() progress {
 	prog := make(progress)
+	now := time.Now().Unix()
 
 	for _, event := range *p {
-		if event.Source == "-" || event.Source == "" || event.Rotated {
+		// stdin and network inputs have no position to record.
+		if event.Source == "-" || event.Source == "" || event.fileinfo == nil {
 			continue
 		}
 
 		ino, dev := file_ids(event.fileinfo)
-		prog[event.Source] = &FileState{
+		end := event.end
+		if end == 0 {
+			end = event.Offset + int64(len(event.Text)) + 1
+		}
+		state := &FileState{
 			Source: event.Source,
-			Offset: event.Offset + int64(len(event.Text)) + 1,
+			Offset: end,
 			Inode:  ino,
 			Device: dev,
+
+			Updated: now,
+			Tail:    event.tail,
+			seq:     event.seq,
 		}
+		prog[state.key()] = state
 	}
 
 	return prog
 }
 
+// acknowledge records that the events in the page were acknowledged by one
+// of their destinations, and returns the events that have now been
+// acknowledged by all of them.
+func (p *eventPage) acknowledge() eventPage {
+	done := make(eventPage, 0, len(*p))
+	for _, event := range *p {
+		if event.acknowledge() {
+			done = append(done, event)
+		}
+	}
+	return done
+}
+
 func (p *eventPage) counts() (map[string]int, map[string]int) {
 	total, bad := make(map[string]int), make(map[string]int)
 	for _, event := range *p {
@@ -56,8 +86,9 @@ func (p *eventPage) empty() bool {
 	return len(*p) == 0
 }
 
-// compress the event page into the destination buffer
-func (p *eventPage) compress(sequenceId uint32, buf *bytes.Buffer) error {
+// compress the event page into the destination buffer, encoding each event
+// as a data frame of the given protocol version.
+func (p *eventPage) compress(version int, sequenceId uint32, buf *bytes.Buffer) error {
 	buf.Reset()
 	z, err := zlib.NewWriterLevel(buf, 3)
 	if err != nil {
@@ -65,7 +96,13 @@ func (p *eventPage) compress(sequenceId uint32, buf *bytes.Buffer) error {
 	}
 
 	for i, e := range *p {
-		e.writeFrame(z, sequenceId+uint32(i))
+		if version == 2 {
+			if err := e.writeJSONFrame(z, sequenceId+uint32(i)); err != nil {
+				return fmt.Errorf("unable to compress eventPage: %v", err)
+			}
+		} else {
+			e.writeFrame(z, sequenceId+uint32(i))
+		}
 	}
 	if err := z.Flush(); err != nil {
 		return fmt.Errorf("unable to compress eventPage: %v", err)
@@ -3,28 +3,106 @@ package main
 import (
 	"log"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 )
 
-// finds files in paths/globs to harvest, starts harvesters
-func Prospect(fileconfig FileConfig, netconf NetworkConfig) {
-	out := netconf.EventChan(fileconfig.Dest)
+// type stopper tells a prospector, and every harvester it started, to stop,
+// and waits for them to finish.  Harvesters that have been told to stop still
+// send the lines they have read, unless they take too long and are aborted.
+type stopper struct {
+	quit  chan struct{}
+	abort chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newStopper() *stopper {
+	return &stopper{quit: make(chan struct{}), abort: make(chan struct{})}
+}
+
+// returns a channel that is closed once we've been told to stop.  A nil
+// stopper never stops.
+func (s *stopper) stopping() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.quit
+}
+
+// reports whether we've been told to stop.
+func (s *stopper) stopped() bool {
+	select {
+	case <-s.stopping():
+		return true
+	default:
+		return false
+	}
+}
+
+// returns a channel that is closed once we've given up waiting for a clean
+// stop.  A nil stopper never aborts.
+func (s *stopper) aborting() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.abort
+}
+
+// runs fn in a goroutine that stop will wait for.
+func (s *stopper) spawn(fn func()) {
+	if s == nil {
+		go fn()
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		fn()
+	}()
+}
+
+// tells everything to stop and waits up to timeout for it to finish.  If it
+// doesn't, anything still sending events is aborted, and stop returns false
+// without waiting any further.
+func (s *stopper) stop(timeout time.Duration) bool {
+	close(s.quit)
+	if s.wait(timeout) {
+		return true
+	}
+	close(s.abort)
+	return false
+}
+
+// waits up to timeout for everything to finish, returning false if it
+// doesn't.
+func (s *stopper) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// finds files in paths/globs to harvest, starts harvesters.  Runs until stop
+// is stopped.
+func Prospect(fileconfig FileConfig, netconf NetworkConfig, stop *stopper) {
+	out := netconf.EventChans(fileconfig.Dest)
 	if out == nil {
-		log.Printf("ERROR unable to start prospector for %v: no event channel", fileconfig.Paths)
+		log.Printf("ERROR unable to start prospector for %v: no event channel for %v", fileconfig.Paths, fileconfig.Dest)
 		return
 	}
 
 	// Handle any "-" (stdin) paths
 	for i, path := range fileconfig.Paths {
 		if path == "-" {
-			harvester := Harvester{
-				Path:   path,
-				Fields: fileconfig.Fields,
-				join:   fileconfig.Join,
-				out:    out,
-			}
-			go harvester.Harvest(0, 0)
+			harvester := newHarvester(path, &fileconfig, out, stop)
+			stop.spawn(func() { harvester.Harvest(0, 0) })
 
 			// Remove it from the file list
 			fileconfig.Paths = append(fileconfig.Paths[:i], fileconfig.Paths[i+1:]...)
@@ -33,69 +111,95 @@ func Prospect(fileconfig FileConfig, netconf NetworkConfig) {
 
 	// Use the registrar db to reopen any files at their last positions
 	fileinfo := make(map[string]os.FileInfo)
-	resume_tracking(fileconfig, fileinfo, out)
+	resume_tracking(fileconfig, fileinfo, out, stop)
+
+	// scan again as soon as a matching file is created.
+	watch := watchGlobs(fileconfig.Paths, fileconfig.ExcludePaths)
+	defer watch.close()
 
 	for {
+		created := watch.take()
 		for _, path := range fileconfig.Paths {
-			prospector_scan(path, &fileconfig, fileinfo, out)
+			prospector_scan(path, &fileconfig, fileinfo, created, out, stop)
 		}
 
 		// Defer next scan for a bit.
-		time.Sleep(10 * time.Second) // Make this tunable
+		select {
+		case <-stop.stopping():
+			log.Printf("prospector for %v stopping", fileconfig.Paths)
+			return
+		case <-watch.wake:
+		case <-time.After(time.Duration(fileconfig.ScanInterval) * time.Second):
+		}
 	}
 } /* Prospect */
 
-func resume_tracking(fileconfig FileConfig, fileinfo map[string]os.FileInfo, output chan *FileEvent) {
+// starts harvesters for the files in the progress file that this prospector
+// read, at their recorded positions.  A file that isn't at its last known path
+// any more is looked for by its inode in the same directory, and read as a
+// rotated file under its new name, unless it has been read to its end.
+func resume_tracking(fileconfig FileConfig, fileinfo map[string]os.FileInfo, output fanout, stop *stopper) {
 	var p progress
 	if err := p.load(options.HistoryPath); err != nil {
 		log.Printf("unable to load lumberjack progress file: %s", err.Error())
 		return
 	}
 
-	for path, state := range p {
-		info, err := os.Stat(path)
-		if err != nil {
-			log.Printf("unable to stat file in resume_tracking: %s", err.Error())
+	for _, state := range p {
+		if !fileconfig.owns(state.Source) {
 			continue
 		}
-
-		if is_file_same(path, info, state) {
-			// same file, seek to last known position
-			fileinfo[path] = info
-
-			for _, pathglob := range fileconfig.Paths {
-				match, err := filepath.Match(pathglob, path)
-				if err != nil {
-					log.Printf("error matching file path: %s", err.Error())
-					continue
-				}
-				if match {
-					log.Printf("resume tracking %s", path)
-					harvester := Harvester{
-						Path:   path,
-						Fields: fileconfig.Fields,
-						join:   fileconfig.Join,
-						out:    output,
-					}
-					go harvester.Harvest(state.Offset, 0)
-					break
-				}
+		path := state.Source
+		info, err := os.Stat(path)
+		if err != nil || !is_file_same(path, info, state) {
+			if path, info = findRenamed(state); path == "" {
+				log.Printf("unable to find %s in resume_tracking; it is gone", state.Source)
+				continue
 			}
+			if !fileconfig.owns(path) {
+				log.Printf("%s was renamed to %s, which isn't one of this prospector's files", state.Source, path)
+				continue
+			}
+		}
+
+		// same file, seek to last known position
+		fileinfo[path] = info
+		if _, rotated := rotatedBase(path, fileconfig.RotateSuffixes); (rotated || path != state.Source) && state.Offset >= info.Size() {
+			// nothing more will be written to it, so don't hold it open.
+			log.Printf("%s was rotated and has been read to its end", path)
+			continue
+		}
+		harvester := newHarvester(path, &fileconfig, output, stop)
+		if path != state.Source {
+			log.Printf("resume tracking %s, renamed from %s", path, state.Source)
+			harvester.moved = true
+		} else {
+			log.Printf("resume tracking %s", path)
 		}
+		offset := state.Offset
+		stop.spawn(func() { harvester.Harvest(offset, 0) })
 	}
 }
 
+// starts harvesters for files matching path that aren't being harvested.
+// Files in created were created while we watched their directory, so they are
+// read from the beginning.
 func prospector_scan(path string, conf *FileConfig,
-	fileinfo map[string]os.FileInfo,
-	output chan *FileEvent) {
+	fileinfo map[string]os.FileInfo, created map[string]bool,
+	output fanout, stop *stopper) {
 
 	// Evaluate the path as a wildcards/shell glob
-	matches, err := filepath.Glob(path)
+	matches, dirs, err := expandGlob(path, conf.ExcludePaths)
 	if err != nil {
 		log.Printf("glob(%s) failed: %v\n", path, err)
 		return
 	}
 
+	// watch the directories matches may be created in.
+	for _, dir := range dirs {
+		watchDir(dir)
+	}
+
 	// If the glob matches nothing, use the path itself as a literal.
 	if len(matches) == 0 && path == "-" {
 		matches = append(matches, path)
@@ -124,31 +228,35 @@ func prospector_scan(path string, conf *FileConfig,
 		// - file path hasn't been seen before
 		// - the file's inode or device changed
 		if !is_known {
-			// TODO(sissel): Skip files with modification dates older than N
-			// TODO(sissel): Make the 'ignore if older than N' tunable
-			if time.Since(info.ModTime()) > 24*time.Hour {
-				log.Printf("skipping old file: %s\n", file)
-			} else if is_file_renamed(file, info, fileinfo) {
+			ignoreOlder := time.Duration(conf.IgnoreOlder) * time.Second
+			if is_file_renamed(file, info, fileinfo) {
 				// Check to see if this file was simply renamed (known inode+dev)
+			} else if isRotation(file, conf, fileinfo) {
+				log.Printf("skipping rotated file: %s\n", file)
+			} else if created[file] {
+				log.Printf("harvest created file: %s\n", file)
+				harvester := newHarvester(file, conf, output, stop)
+				stop.spawn(func() { harvester.Harvest(0, h_Rewind) })
+			} else if ignoreOlder > 0 && time.Since(info.ModTime()) > ignoreOlder {
+				log.Printf("skipping old file: %s\n", file)
 			} else {
 				log.Printf("harvest new file: %s\n", file)
-				harvester := Harvester{
-					Path:   file,
-					Fields: conf.Fields,
-					join:   conf.Join,
-					out:    output,
-				}
-				go harvester.Harvest(0, 0)
+				harvester := newHarvester(file, conf, output, stop)
+				stop.spawn(func() { harvester.Harvest(0, 0) })
 			}
 		} else if !is_fileinfo_same(lastinfo, info) {
 			log.Printf("harvest rotated file: %s\n", file)
-			harvester := Harvester{
-				Path:   file,
-				Fields: conf.Fields,
-				join:   conf.Join,
-				out:    output,
+			registry.forget(file)
+			harvester := newHarvester(file, conf, output, stop)
+			stop.spawn(func() { harvester.Harvest(0, h_Rewind) })
+		} else if offset, ok := registry.reopen(file, info.Size()); ok {
+			log.Printf("harvest inactive file that changed: %s\n", file)
+			harvester := newHarvester(file, conf, output, stop)
+			opt := 0
+			if offset == 0 {
+				opt = h_Rewind
 			}
-			go harvester.Harvest(0, h_Rewind)
+			stop.spawn(func() { harvester.Harvest(offset, opt) })
 		}
 	} // for each file matched by the glob
 }
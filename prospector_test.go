@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var watching sync.Once
+
+// starts handling inotify events, once for all tests.
+func startWatching(t *testing.T) {
+	if registry == nil {
+		registry = newRegistry(&Config{})
+	}
+	if watcher == nil {
+		t.Skip("inotify unavailable")
+	}
+	watching.Do(func() { go reportFSEvents() })
+}
+
+// starts a prospector for glob that only scans once a minute, so anything it
+// finds quickly was found through inotify.  conf may give more of the files
+// entry.  Returns its event channel.
+func startProspector(t *testing.T, glob string, conf map[string]interface{}) (chan *FileEvent, *stopper) {
+	startWatching(t)
+
+	if conf == nil {
+		conf = make(map[string]interface{})
+	}
+	conf["paths"] = []string{glob}
+	conf["scan_interval"] = 60
+	var fileconfig FileConfig
+	b, _ := json.Marshal(conf)
+	if err := json.Unmarshal(b, &fileconfig); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	c := make(chan *FileEvent, 16)
+	netconf := NetworkConfig{"default": NetworkGroup{c_events: c}}
+	s := newStopper()
+	s.spawn(func() { Prospect(fileconfig, netconf, s) })
+	time.Sleep(50 * time.Millisecond)
+	return c, s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "lumberjack")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	return dir
+}
+
+func TestCreatedFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, s := startProspector(t, filepath.Join(dir, "*.log"), nil)
+	defer s.stop(time.Second)
+
+	path := filepath.Join(dir, "app.log")
+	if err := ioutil.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if e := receive(t, c); e.Text != "hello" || e.Source != path {
+		t.Errorf("expected hello from %s, got %q from %s", path, e.Text, e.Source)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("unable to remove file: %v", err)
+	}
+	for i := 0; registry.byPath(path) != nil; i++ {
+		if i == 10 {
+			t.Fatalf("harvester still running for deleted file")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestCreatedDirectory(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	c, s := startProspector(t, filepath.Join(dir, "**/*.log"), nil)
+	defer s.stop(time.Second)
+
+	// the file may be written before the new directories are watched.
+	path := filepath.Join(dir, "web", "2", "app.log")
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if e := receive(t, c); e.Text != "hello" || e.Source != path {
+		t.Errorf("expected hello from %s, got %q from %s", path, e.Text, e.Source)
+	}
+
+	// and later files are seen through the new watches.
+	path = filepath.Join(dir, "web", "2", "other.log")
+	if err := ioutil.WriteFile(path, []byte("again\n"), 0644); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	if e := receive(t, c); e.Text != "again" || e.Source != path {
+		t.Errorf("expected again from %s, got %q from %s", path, e.Text, e.Source)
+	}
+}
+
+// appends lines to the file at path, creating it if need be.
+func appendLines(t *testing.T, path string, lines ...string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	defer f.Close()
+	for _, line := range lines {
+		f.Write([]byte(line + "\n"))
+	}
+}
+
+// receives events until none arrive for a while, checking that they are the
+// lines expected, from the files expected, in any order.  Lines expected from
+// "any" file may come from any of them.
+func expectLines(t *testing.T, c chan *FileEvent, want map[string]string) {
+	got := make(map[string]string)
+	for {
+		select {
+		case e := <-c:
+			if _, ok := got[e.Text]; ok {
+				t.Errorf("line %q sent twice", e.Text)
+			}
+			got[e.Text] = filepath.Base(e.Source)
+			if want[e.Text] == "any" {
+				got[e.Text] = "any"
+			}
+			continue
+		case <-time.After(500 * time.Millisecond):
+		}
+		break
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected lines from files %v, got %v", want, got)
+	}
+}
+
+// starts a prospector for app.log* in a new directory, and writes a first
+// line to app.log.
+func startRotation(t *testing.T, conf map[string]interface{}) (string, chan *FileEvent, *stopper) {
+	dir := tempDir(t)
+	c, s := startProspector(t, filepath.Join(dir, "app.log*"), conf)
+	appendLines(t, filepath.Join(dir, "app.log"), "1")
+	expectLines(t, c, map[string]string{"1": "app.log"})
+	return dir, c, s
+}
+
+func TestRotateRename(t *testing.T) {
+	dir, c, s := startRotation(t, nil)
+	defer os.RemoveAll(dir)
+	defer s.stop(time.Second)
+	path := filepath.Join(dir, "app.log")
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("unable to open file: %v", err)
+	}
+	defer f.Close()
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("unable to rename file: %v", err)
+	}
+	// the writer hasn't reopened its file yet.
+	f.Write([]byte("2\n"))
+	appendLines(t, path, "3")
+	expectLines(t, c, map[string]string{"2": "app.log.1", "3": "app.log"})
+}
+
+func TestRotateCopyTruncate(t *testing.T) {
+	dir, c, s := startRotation(t, nil)
+	defer os.RemoveAll(dir)
+	defer s.stop(time.Second)
+	path := filepath.Join(dir, "app.log")
+
+	// the copy may be made before the harvester reads the last line, and the
+	// file is written to again before it notices the truncation.
+	appendLines(t, path, "2")
+	b, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path+".1", b, 0644); err != nil {
+		t.Fatalf("unable to copy file: %v", err)
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("unable to truncate file: %v", err)
+	}
+	appendLines(t, path, "3", "4")
+	expectLines(t, c, map[string]string{"2": "any", "3": "app.log", "4": "app.log"})
+}
+
+func TestFindCopy(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	appendLines(t, path, "1", "2")
+	ioutil.WriteFile(filepath.Join(dir, "other.log"), []byte("1\n3\n"), 0644)
+
+	h := newHarvester(path, &FileConfig{}, nil, nil)
+	h.open(0, h_Rewind)
+	defer h.file.Close()
+	h.remember([]byte("1\n"))
+
+	// the copy has the line we last read at our offset, and more after it.
+	appendLines(t, path, "3")
+	b, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(filepath.Join(dir, "app.log-copy"), b, 0644)
+	os.Truncate(path, 0)
+	appendLines(t, path, "4")
+
+	if s, _ := h.status(2); s != hf_Trunc {
+		t.Errorf("expected truncated file, got status %v", s)
+	}
+	if got := h.findCopy(2); filepath.Base(got) != "app.log-copy" {
+		t.Errorf("expected app.log-copy to be found, got %q", got)
+	}
+}
+
+func TestRotateDelayCompress(t *testing.T) {
+	dir, c, s := startRotation(t, nil)
+	defer os.RemoveAll(dir)
+	defer s.stop(time.Second)
+	path := filepath.Join(dir, "app.log")
+
+	os.Rename(path, path+".1")
+	appendLines(t, path, "2")
+	expectLines(t, c, map[string]string{"2": "app.log"})
+
+	// the first rotation is only compressed on the second.
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	b, _ := ioutil.ReadFile(path + ".1")
+	z.Write(b)
+	z.Close()
+	if err := ioutil.WriteFile(path+".2.gz", buf.Bytes(), 0644); err != nil {
+		t.Fatalf("unable to write compressed file: %v", err)
+	}
+	os.Remove(path + ".1")
+	os.Rename(path, path+".1")
+	appendLines(t, path, "3")
+	expectLines(t, c, map[string]string{"3": "app.log"})
+}
+
+func TestRotateSuffixes(t *testing.T) {
+	dir, c, s := startRotation(t, map[string]interface{}{
+		"rotate_suffixes": []string{`\.\d{4}-\d{2}-\d{2}-\d{2}$`},
+	})
+	defer os.RemoveAll(dir)
+	defer s.stop(time.Second)
+	path := filepath.Join(dir, "app.log")
+
+	// a copy that isn't named as a rotation would be read as a new file.
+	b, _ := ioutil.ReadFile(path)
+	if err := ioutil.WriteFile(path+".2026-10-18-09", b, 0644); err != nil {
+		t.Fatalf("unable to copy file: %v", err)
+	}
+	os.Truncate(path, 0)
+	appendLines(t, path, "2")
+	expectLines(t, c, map[string]string{"2": "app.log"})
+}
+
+func TestResumeRenamed(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := options
+	defer func() { options = saved }()
+	options.HistoryPath = filepath.Join(dir, ".lumberjack")
+
+	// we'd read the first line of each file when we stopped, and they were
+	// rotated and, except for done.log, written to before we started again.
+	p := make(progress)
+	for _, name := range []string{"app.log", "excluded.log", "reused.log", "done.log"} {
+		path := filepath.Join(dir, name)
+		appendLines(t, path, "1")
+		info, _ := os.Stat(path)
+		state := &FileState{Source: path, Offset: 2, Tail: "1\n"}
+		state.Inode, state.Device = file_ids(info)
+		p[state.key()] = state
+		os.Rename(path, path+".1")
+		if name != "done.log" {
+			appendLines(t, path+".1", name)
+		}
+	}
+	// a new file given the inode of one we'd read doesn't have its line.
+	reused := progressOf(p, filepath.Join(dir, "reused.log"))
+	reused.Tail = "x\n"
+	if err := p.save(options.HistoryPath, false); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	c, s := startProspector(t, filepath.Join(dir, "*.log"), map[string]interface{}{
+		"exclude_paths": []string{filepath.Join(dir, "excluded.log.*")},
+	})
+	defer s.stop(time.Second)
+	expectLines(t, c, map[string]string{"app.log": "app.log.1"})
+	// a rotated file already read to its end isn't held open.
+	if registry.byPath(filepath.Join(dir, "done.log.1")) != nil {
+		t.Errorf("done.log.1 was read to its end, but is being harvested")
+	}
+	if registry.byPath(filepath.Join(dir, "app.log.1")) == nil {
+		t.Errorf("app.log.1 isn't being harvested")
+	}
+}
+
+func TestRenamedAfterUntrimmedLine(t *testing.T) {
+	if registry == nil {
+		registry = newRegistry(&Config{})
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := partialLineWait
+	defer func() { partialLineWait = saved }()
+	partialLineWait = 50 * time.Millisecond
+
+	// the last line read is indented, or partial and sent after
+	// partialLineWait, so its event's text isn't what ends at the offset.
+	for name, text := range map[string]string{
+		"indented.log": "first\n  indented  \n",
+		"partial.log":  "first\n  partial",
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", name, err)
+		}
+		c := make(chan *FileEvent, 4)
+		h := newHarvester(path, &FileConfig{}, fanout{c}, nil)
+		h.open(0, h_Rewind)
+		h.readlines(200 * time.Millisecond)
+		h.file.Close()
+
+		var page eventPage
+		for len(c) > 0 {
+			page = append(page, <-c)
+		}
+		state := progressOf(page.progress(), path)
+		if state.Offset != int64(len(text)) {
+			t.Errorf("%s read to %d, expected %d", name, state.Offset, len(text))
+		}
+		os.Rename(path, path+".1")
+		if renamed, _ := findRenamed(state); renamed != path+".1" {
+			t.Errorf("%s renamed to %s.1, found %q", name, name, renamed)
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"net"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -22,126 +24,424 @@ func init() {
 type Publisher struct {
 	id        int           // unique publisher id
 	buffer    bytes.Buffer  // recyclable buffer for data to be sent
-	socket    *tls.Conn     // currently active connection. may be nil.
+	socket    net.Conn      // currently active tls connection. may be nil.
 	sequence  uint32        // incremental event id for current connection.
 	addr      string        // tcp address to connect to
 	tlsConfig tls.Config    // tls config to use for establishing secure connection
 	timeout   time.Duration // send timeout
+	window    int           // maximum number of unacknowledged events in flight
+	version   int           // protocol version used for data frames
+	health    health        // failure and latency tracking, read by the dispatcher
+
+	input chan eventPage // pages handed to us by the dispatcher
+	wake  chan struct{}  // tells the dispatcher we may be ready for a page
+	group chan eventPage // the network group's unsent pages, for requeueing
+	quit  chan struct{}  // closed when the publisher should stop
+
+	inflight []*pendingPage // pages written to the socket, oldest first
+	deadline time.Time      // time by which we expect the next ack
+
+	acks   chan uint32   // acknowledged sequence numbers from the current connection
+	errs   chan error    // read errors from the current connection
+	closed chan struct{} // closed when the current connection is abandoned
+}
+
+// type pendingPage is an eventPage that has been written to the socket but
+// not yet fully acknowledged by the server.
+type pendingPage struct {
+	page  eventPage
+	first uint32    // sequence number of page[0]
+	acked int       // number of leading events acknowledged so far
+	sent  time.Time // when the page was last written
+}
+
+// type health is a publisher's circuit breaker.  After maxFailures
+// consecutive failures the breaker opens and the dispatcher stops handing the
+// publisher pages until cooldown has passed or an ack arrives.
+type health struct {
+	sync.Mutex
+	failures    int           // consecutive failures
+	maxFailures int           // failures before the breaker opens
+	cooldown    time.Duration // how long the breaker stays open
+	openUntil   time.Time
+	rtt         time.Duration // moving average of ack round-trip time
+}
+
+// whether the dispatcher should hand us pages.  A breaker whose cooldown has
+// passed is half-open: we get pages again, and the next failure reopens it.
+func (p *Publisher) healthy() bool {
+	p.health.Lock()
+	defer p.health.Unlock()
+	return p.health.failures < p.health.maxFailures || time.Now().After(p.health.openUntil)
+}
+
+func (p *Publisher) latency() time.Duration {
+	p.health.Lock()
+	defer p.health.Unlock()
+	return p.health.rtt
+}
+
+// records a failure, returning true if the breaker is now open.
+func (p *Publisher) failed() bool {
+	p.health.Lock()
+	defer p.health.Unlock()
+	p.health.failures++
+	if p.health.failures < p.health.maxFailures {
+		return false
+	}
+	if p.health.failures == p.health.maxFailures || time.Now().After(p.health.openUntil) {
+		log.Printf("publisher %d to %s failed %d times in a row, suspending it for %v", p.id, p.addr, p.health.failures, p.health.cooldown)
+		p.health.openUntil = time.Now().Add(p.health.cooldown)
+	}
+	return true
+}
+
+// records an ack, closing the breaker.  rtt is the round trip time of a fully
+// acknowledged page, or zero for a partial ack.
+func (p *Publisher) succeeded(rtt time.Duration) {
+	p.health.Lock()
+	defer p.health.Unlock()
+	p.health.failures = 0
+	if rtt == 0 {
+		return
+	}
+	if p.health.rtt == 0 {
+		p.health.rtt = rtt
+	} else {
+		p.health.rtt = (4*p.health.rtt + rtt) / 5
+	}
+}
+
+// fail records a connection failure.  Once the circuit breaker opens, the
+// unacknowledged events in flight are handed back to the network group so
+// that a healthy server can send them while we wait to reconnect.
+func (p *Publisher) fail() {
+	if !p.failed() || p.group == nil {
+		return
+	}
+	p.handBack()
 }
 
+// hands the unacknowledged events in flight back to the network group.
+func (p *Publisher) handBack() {
+	if len(p.inflight) == 0 {
+		return
+	}
+	if p.group == nil {
+		log.Printf("publisher %d dropping %d unacknowledged events", p.id, p.unacked())
+		for _, pp := range p.inflight {
+			for _, e := range pp.page[pp.acked:] {
+				e.drop()
+			}
+		}
+		p.inflight = nil
+		return
+	}
+	pages := make([]eventPage, 0, len(p.inflight))
+	for _, pp := range p.inflight {
+		pages = append(pages, pp.page[pp.acked:])
+	}
+	p.inflight = nil
+	go requeue(p.group, pages)
+}
+
+// sleeps for d, returning false if the publisher was told to stop first.
+func (p *Publisher) sleep(d time.Duration) bool {
+	select {
+	case <-p.quit:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// the last sequence number in the page
+func (pp *pendingPage) last() uint32 {
+	return pp.first + uint32(len(pp.page)) - 1
+}
+
+// compares sequence numbers, allowing for roll-over.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// publishes pages from input until input is closed or the publisher is told
+// to stop.  When told to stop, anything still in flight is handed back to the
+// network group.
 func (p *Publisher) publish(input chan eventPage, registrar chan eventPage) {
-	p.connect()
 	defer func() {
 		log.Printf("publisher %v done", p.id)
+		p.handBack()
+		if p.socket == nil {
+			return
+		}
+		if p.closed != nil {
+			close(p.closed)
+		}
 		if err := p.socket.Close(); err != nil {
 			log.Printf("unable to close connection to logstash server %s on publisher end: %v\n", p.addr, err)
 		}
 	}()
+	if !p.connect() {
+		return
+	}
 
 	if input == nil {
 		log.Println("publisher input channel is nil you dummy")
 	}
 
-SENDING:
-	for page := range input {
-		if err := page.compress(p.sequence, &p.buffer); err != nil {
-			log.Println(err)
-			//  if we hit this, we've lost log lines.  This is potentially
-			//  fatal and should alert a human.
-			continue
+	for {
+		// stop reading new pages while the window is full.
+		var in chan eventPage
+		if p.unacked() < p.window {
+			in = input
+			select {
+			case p.wake <- struct{}{}:
+			default:
+			}
 		}
-		p.sequence += uint32(len(page))
-		compressed_payload := p.buffer.Bytes()
 
-	SENDPAYLOAD:
-		if err := p.sendPayload(len(page), compressed_payload); err != nil {
-			input <- page
-			sleep := time.Duration(1e9 + rand.Intn(1e10))
-			log.Printf("Socket error, will reconnect in %v: %s\n", sleep, err)
-			time.Sleep(sleep)
-			if err := p.socket.Close(); err != nil {
-				log.Printf("unable to close connection to logstash server %s during sendpayload: %v\n", p.addr, err)
+		var timeout <-chan time.Time
+		if len(p.inflight) > 0 {
+			timeout = time.After(p.deadline.Sub(time.Now()))
+		} else if input == nil {
+			return
+		}
+
+		select {
+		case page, ok := <-in:
+			if !ok {
+				input = nil
+				continue
 			}
-			p.connect()
-			continue SENDING
-		}
-
-		// read ack
-		response := make([]byte, 6)
-		ackbytes := 0
-		for ackbytes != 6 {
-			n, err := p.socket.Read(response)
-			if err != nil {
-				log.Printf("Read error after %d bytes looking for ack: %s\n", n, err)
-				log.Println("page will be re-sent")
-				log.Println("closing socket to %s", p.addr)
-				if err := p.socket.Close(); err != nil {
-					log.Printf("unable to close connection to logstash server %s during ack: %v\n", p.addr, err)
-				} else {
-					log.Printf("publisher closed connection to %s\n", p.addr)
-				}
-				p.connect()
-				goto SENDPAYLOAD
-			} else {
-				ackbytes += n
+			if page.empty() {
+				continue
+			}
+			if err := p.send(page, 0); err != nil && !p.reconnect(err) {
+				return
+			}
+		case seq := <-p.acks:
+			p.ack(seq, registrar)
+		case err := <-p.errs:
+			if !p.reconnect(fmt.Errorf("read error looking for ack: %v", err)) {
+				return
+			}
+		case <-timeout:
+			if !p.reconnect(fmt.Errorf("timed out after %v waiting for ack", p.timeout)) {
+				return
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// the number of events written to the socket that have not yet been
+// acknowledged.
+func (p *Publisher) unacked() int {
+	n := 0
+	for _, pp := range p.inflight {
+		n += len(pp.page) - pp.acked
+	}
+	return n
+}
+
+// send compresses and writes the unacknowledged tail of a page, starting at
+// event 'acked', to the socket.  The page is tracked as in flight whether or
+// not the write succeeds, so that a failed write is retried on reconnect.
+func (p *Publisher) send(page eventPage, acked int) error {
+	if len(p.inflight) == 0 {
+		p.deadline = time.Now().Add(p.timeout)
+	}
+	tail := page[acked:]
+	p.inflight = append(p.inflight, &pendingPage{
+		page:  page,
+		first: p.sequence - uint32(acked),
+		acked: acked,
+		sent:  time.Now(),
+	})
+	if err := tail.compress(p.version, p.sequence, &p.buffer); err != nil {
+		//  if we hit this, we've lost log lines.  This is potentially
+		//  fatal and should alert a human.
+		p.inflight = p.inflight[:len(p.inflight)-1]
+		log.Println(err)
+		for _, e := range tail {
+			e.drop()
+		}
+		return nil
+	}
+	p.sequence += uint32(len(tail))
+	return p.sendPayload(len(tail), p.buffer.Bytes())
+}
+
+// ack handles an acknowledgement of every event up to and including seq.
+// Each newly acknowledged run of events is handed to the registrar as soon as
+// it is acked, so a partially acknowledged page still advances the progress
+// file to the last line logstash confirmed.
+func (p *Publisher) ack(seq uint32, registrar chan eventPage) {
+	p.deadline = time.Now().Add(p.timeout)
+	for len(p.inflight) > 0 {
+		pp := p.inflight[0]
+		if seqBefore(seq, pp.first) {
+			return
+		}
+		if seqBefore(seq, pp.last()) {
+			if n := int(seq-pp.first) + 1; n > pp.acked {
+				p.succeeded(0)
+				log.Printf("publisher %d sent %d of %d events to %s", p.id, n, len(pp.page), p.addr)
+				registrar <- pp.page[pp.acked:n]
+				pp.acked = n
 			}
+			return
 		}
 
-		// TODO(sissel): verify ack
+		p.succeeded(time.Since(pp.sent))
 
 		// Tell the registrar that we've successfully sent these events
-		log.Printf("publisher %d sent %d events to %s", p.id, len(page), p.addr)
-		registrar <- page
-	} /* for each event payload */
+		log.Printf("publisher %d sent %d events to %s", p.id, len(pp.page)-pp.acked, p.addr)
+		registrar <- pp.page[pp.acked:]
+		p.inflight[0] = nil
+		p.inflight = p.inflight[1:]
+	}
+}
 
+// reconnect drops the current connection, establishes a new one, and resends
+// the unacknowledged tail of every page in flight.  It does not return until
+// all of them have been written to the new connection, or the publisher is
+// told to stop, in which case it returns false.
+func (p *Publisher) reconnect(reason error) bool {
+	for reason != nil {
+		sleep := time.Duration(1e9 + rand.Intn(1e10))
+		log.Printf("Socket error, will reconnect in %v: %s\n", sleep, reason)
+		p.fail()
+		p.disconnect()
+		if !p.sleep(sleep) || !p.connect() {
+			return false
+		}
+		reason = p.resend()
+	}
+	return true
+}
+
+func (p *Publisher) resend() error {
+	pending := p.inflight
+	p.inflight = make([]*pendingPage, 0, len(pending))
+	for i, pp := range pending {
+		log.Printf("publisher %d resending %d of %d events to %s", p.id, len(pp.page)-pp.acked, len(pp.page), p.addr)
+		if err := p.send(pp.page, pp.acked); err != nil {
+			// keep the rest in flight for the next attempt.
+			for _, rest := range pending[i+1:] {
+				p.inflight = append(p.inflight, rest)
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 func (p *Publisher) sendPayload(size int, payload []byte) error {
-	if err := p.socket.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+	if err := p.socket.SetWriteDeadline(time.Now().Add(p.timeout)); err != nil {
 		return fmt.Errorf("unable to set deadline in sendPayload: %v", err)
 	}
 
 	w := &errorWriter{Writer: p.socket}
+	v := byte('0' + p.version)
 
 	// Set the window size to the length of this payload in events.
-	w.Write([]byte("1W"))
+	w.Write([]byte{v, frameWindow})
 	binary.Write(w, binary.BigEndian, uint32(size))
 
 	// Write compressed frame
-	w.Write([]byte("1C"))
+	w.Write([]byte{v, frameCompressed})
 	binary.Write(w, binary.BigEndian, uint32(len(payload)))
 	w.Write(payload)
 
 	return w.Err()
 }
 
-func (p *Publisher) connect() {
+// readAcks reads ack frames from the connection until it fails or the
+// connection is abandoned.
+func readAcks(r io.Reader, acks chan uint32, errs chan error, closed chan struct{}) {
+	frames := newFrameReader(r)
+	for {
+		fr, err := frames.next()
+		if err != nil {
+			errs <- err
+			return
+		}
+		if fr.kind != frameAck {
+			errs <- fmt.Errorf("unexpected frame type %q", fr.kind)
+			return
+		}
+		select {
+		case acks <- fr.seq:
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (p *Publisher) disconnect() {
+	if p.closed != nil {
+		close(p.closed)
+		p.closed = nil
+	}
+	if err := p.socket.Close(); err != nil {
+		log.Printf("unable to close connection to logstash server %s: %v\n", p.addr, err)
+	} else {
+		log.Printf("publisher closed connection to %s\n", p.addr)
+	}
+	p.socket = nil
+}
+
+// connects to the server, retrying until it succeeds.  Returns false if the
+// publisher is told to stop first.
+func (p *Publisher) connect() bool {
 	for {
 		sock, err := net.DialTimeout("tcp", p.addr, p.timeout)
 		if err != nil {
 			sleep := time.Duration(1e9 + rand.Intn(1e10))
 			log.Printf("Failure connecting publisher %v to %s: %s\n", p.id, p.addr, err)
 			log.Printf("reconnect in %v", sleep)
-			time.Sleep(sleep)
+			p.fail()
+			if !p.sleep(sleep) {
+				return false
+			}
 			continue
 		}
-		p.socket = tls.Client(sock, &p.tlsConfig)
-		if err := p.socket.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		conn := tls.Client(sock, &p.tlsConfig)
+		if err := conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
 			log.Printf("unable to set deadline in connect: %v\n", err)
 			continue
 		}
-		if err := p.socket.Handshake(); err != nil {
+		if err := conn.Handshake(); err != nil {
 			sleep := time.Duration(1e9 + rand.Intn(1e10))
 			log.Printf("Failed to tls handshake with %s %s\n", p.addr, err)
-			time.Sleep(sleep)
-			if err := p.socket.Close(); err != nil {
+			p.fail()
+			if err := conn.Close(); err != nil {
 				log.Printf("unable to close connection to logstash server %s during handshake: %v\n", p.addr, err)
 			} else {
 				log.Printf("publisher closed connection to %s during handshake\n", p.addr)
 			}
+			if !p.sleep(sleep) {
+				return false
+			}
 			continue
 		}
+		// acks are waited on by the publish loop, not by read deadlines.
+		conn.SetReadDeadline(time.Time{})
+		p.attach(conn)
+
 		log.Printf("Publisher %v connected to %s\n", p.id, p.addr)
-		return
+		return true
 	}
 }
+
+// makes conn the publisher's connection, and starts reading acks from it.
+func (p *Publisher) attach(conn net.Conn) {
+	p.socket = conn
+	p.acks = make(chan uint32, 16)
+	p.errs = make(chan error, 1)
+	p.closed = make(chan struct{})
+	go readAcks(conn, p.acks, p.errs, p.closed)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// type testServer is the far end of a publisher's connection.  It decodes the
+// data frames the publisher writes, and sends acks.
+type testServer struct {
+	t      *testing.T
+	conn   net.Conn
+	frames chan *frame
+}
+
+// gives the publisher a new connection to a test server.
+func connectTest(t *testing.T, p *Publisher) *testServer {
+	client, server := net.Pipe()
+	s := &testServer{t: t, conn: server, frames: make(chan *frame, 64)}
+	go func() {
+		r := newFrameReader(server)
+		for {
+			fr, err := r.next()
+			if err != nil {
+				return
+			}
+			if fr.kind == frameData {
+				s.frames <- fr
+			}
+		}
+	}()
+	p.attach(client)
+	return s
+}
+
+// receives the next n data frames, returning their sequence numbers and lines.
+func (s *testServer) receive(n int) []string {
+	var got []string
+	for i := 0; i < n; i++ {
+		select {
+		case fr := <-s.frames:
+			got = append(got, fmt.Sprintf("%d:%s", fr.seq, fr.fields["line"]))
+		case <-time.After(time.Second):
+			s.t.Fatalf("expected %d frames, got %v", n, got)
+		}
+	}
+	select {
+	case fr := <-s.frames:
+		s.t.Errorf("unexpected frame %d: %v", fr.seq, fr.fields)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return got
+}
+
+// acks every event up to seq, and has the publisher handle the ack.
+func (s *testServer) ack(p *Publisher, seq uint32, registrar chan eventPage) {
+	var b bytes.Buffer
+	b.Write([]byte("1A"))
+	binary.Write(&b, binary.BigEndian, seq)
+	s.conn.Write(b.Bytes())
+	select {
+	case got := <-p.acks:
+		p.ack(got, registrar)
+	case <-time.After(time.Second):
+		s.t.Fatalf("ack %d not read", seq)
+	}
+}
+
+// checks the lines of the pages handed to the registrar since last checked.
+func expectAcked(t *testing.T, registrar chan eventPage, want ...string) {
+	var got []string
+	for len(registrar) > 0 {
+		var lines []string
+		for _, e := range <-registrar {
+			lines = append(lines, e.Text)
+		}
+		got = append(got, fmt.Sprint(lines))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v acked, got %v", want, got)
+	}
+}
+
+func testEvents(prefix string, n int) eventPage {
+	page := make(eventPage, n)
+	for i := range page {
+		page[i] = &FileEvent{Source: "/var/log/app.log", Text: fmt.Sprintf("%s%d", prefix, i)}
+	}
+	return page
+}
+
+func TestSeqBefore(t *testing.T) {
+	for _, c := range []struct {
+		a, b   uint32
+		before bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{2, 2, false},
+		{math.MaxUint32, 0, true},
+		{0, math.MaxUint32, false},
+		{math.MaxUint32 - 1, 3, true},
+	} {
+		if seqBefore(c.a, c.b) != c.before {
+			t.Errorf("seqBefore(%d, %d) should be %v", c.a, c.b, c.before)
+		}
+	}
+}
+
+func TestPublisherWindow(t *testing.T) {
+	// sequence numbers roll over part way through the first page.
+	p := &Publisher{sequence: math.MaxUint32 - 1, timeout: time.Second, window: 6, version: 1}
+	p.health.maxFailures = 3
+	registrar := make(chan eventPage, 8)
+	s := connectTest(t, p)
+
+	a, b := testEvents("a", 3), testEvents("b", 3)
+	p.send(a, 0)
+	p.send(b, 0)
+	want := []string{"4294967294:a0", "4294967295:a1", "0:a2", "1:b0", "2:b1", "3:b2"}
+	if got := s.receive(6); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected frames %v, got %v", want, got)
+	}
+	if n := p.unacked(); n != 6 {
+		t.Errorf("expected 6 events in flight, got %d", n)
+	}
+	s.ack(p, math.MaxUint32-2, registrar)
+	expectAcked(t, registrar)
+
+	// an ack for part of a page, then one across the rest of it and part of
+	// the next.
+	s.ack(p, math.MaxUint32, registrar)
+	expectAcked(t, registrar, "[a0 a1]")
+	s.ack(p, math.MaxUint32, registrar)
+	expectAcked(t, registrar)
+	if n := p.unacked(); n != 4 {
+		t.Errorf("expected 4 events in flight after a partial ack, got %d", n)
+	}
+	s.ack(p, 2, registrar)
+	expectAcked(t, registrar, "[a2]", "[b0 b1]")
+	if n := p.unacked(); n != 1 || len(p.inflight) != 1 {
+		t.Errorf("expected 1 event of 1 page in flight, got %d of %d", n, len(p.inflight))
+	}
+
+	// only what wasn't acked is sent again after reconnecting.
+	p.disconnect()
+	s = connectTest(t, p)
+	if err := p.resend(); err != nil {
+		t.Fatalf("resend failed: %v", err)
+	}
+	if got := s.receive(1); fmt.Sprint(got) != "[4:b2]" {
+		t.Errorf("expected only b2 resent, got %v", got)
+	}
+	s.ack(p, 4, registrar)
+	expectAcked(t, registrar, "[b2]")
+	if len(p.inflight) != 0 {
+		t.Errorf("expected nothing in flight, got %d pages", len(p.inflight))
+	}
+	p.disconnect()
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fsync policies for the disk queue
+const (
+	fsync_Always  = "always"  // sync every page as it is queued
+	fsync_Segment = "segment" // sync each segment file when it is closed
+	fsync_Never   = "never"   // leave it to the OS
+)
+
+// type diskQueue persists pages between a network group's spooler and its
+// publishers, so that they survive restarts and long outages.  Pages are
+// appended to numbered segment files in the queue directory.  A segment is
+// deleted once every page in it has been read and acknowledged, and the
+// position within the oldest segment is recorded in an ack file, so pages
+// are replayed from there after a restart.
+//
+// Once a page has been queued, the registrar treats it as delivered: the
+// progress file records what is durably queued, and the queue takes care of
+// what has actually been acknowledged by logstash.
+type diskQueue struct {
+	sync.Mutex
+	cond *sync.Cond
+
+	dir         string
+	maxSize     int64 // total bytes of segments to keep on disk
+	segmentSize int64 // bytes after which a new segment is started
+	fsync       string
+
+	segments []*segment // oldest first.  The last one is being written.
+	size     int64      // total bytes of all segments
+
+	writing *segment
+	w       *os.File
+	reading *segment
+	r       *os.File
+
+	ackSegment uint64 // the position last recorded in the ack file
+	ackRecords int
+}
+
+// type segment is a single queue file.
+type segment struct {
+	id      uint64
+	size    int64
+	written int    // records written this run, or -1 if found on startup
+	closed  bool   // no more records will be written
+	drained bool   // every record has been read
+	skip    int    // records acknowledged before a restart
+	acked   []bool // ack status of every record read so far
+	prefix  int    // number of leading records acknowledged
+}
+
+// type queueRecord identifies the queued page an event was read from, so
+// that publisher acks can be applied to the queue.
+type queueRecord struct {
+	seg   *segment
+	index int
+	count int // events in the page
+	acked int // events acknowledged so far
+}
+
+func openQueue(dir string, maxSize, segmentSize int64, fsync string) (*diskQueue, error) {
+	switch fsync {
+	case fsync_Always, fsync_Segment, fsync_Never:
+	default:
+		return nil, fmt.Errorf("unknown queue fsync policy: %s", fsync)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create queue directory: %v", err)
+	}
+	q := &diskQueue{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		fsync:       fsync,
+	}
+	q.cond = sync.NewCond(q)
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read queue directory: %v", err)
+	}
+	for _, fi := range infos {
+		if !strings.HasSuffix(fi.Name(), ".seg") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(fi.Name(), ".seg"), 10, 64)
+		if err != nil {
+			log.Printf("queue ignoring unknown file %s", fi.Name())
+			continue
+		}
+		q.segments = append(q.segments, &segment{id: id, size: fi.Size(), written: -1, closed: true})
+		q.size += fi.Size()
+	}
+	sort.Sort(bySegmentId(q.segments))
+
+	if len(q.segments) > 0 {
+		q.ackSegment, q.ackRecords = q.readAckFile()
+		if oldest := q.segments[0]; oldest.id == q.ackSegment {
+			oldest.skip = q.ackRecords
+		}
+		log.Printf("queue %s replaying %d bytes in %d segments", dir, q.size, len(q.segments))
+	}
+
+	var next uint64 = 1
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1].id + 1
+	}
+	if err := q.startSegment(next); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// fill persists pages from the spooler, handing each one to the registrar
+// once it is written to the queue.  Unless every page is synced, a crash can
+// lose pages the progress file already records.  A page that can't be queued
+// is sent straight to the publishers instead, and only registered once it is
+// acknowledged.
+func (q *diskQueue) fill(input, output, registrar chan eventPage) {
+	for page := range input {
+		if err := q.put(page); err != nil {
+			log.Printf("unable to queue page, sending it directly: %v", err)
+			output <- page
+			continue
+		}
+		registrar <- page
+	}
+}
+
+// drain reads queued pages and hands them to the group's publishers.
+func (q *diskQueue) drain(output chan eventPage) {
+	for {
+		output <- q.get()
+	}
+}
+
+// track applies the acknowledgements of publishers to the queue.  Pages that
+// never made it into the queue are passed on to the registrar.
+func (q *diskQueue) track(acks, registrar chan eventPage) {
+	for page := range acks {
+		unqueued := q.ack(page)
+		if !unqueued.empty() {
+			registrar <- unqueued
+		}
+	}
+}
+
+func (q *diskQueue) put(page eventPage) error {
+	data, err := json.Marshal(page)
+	if err != nil {
+		return fmt.Errorf("unable to encode page: %v", err)
+	}
+	record := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[8:], data)
+
+	q.Lock()
+	defer q.Unlock()
+
+	for q.size > 0 && q.size+int64(len(record)) > q.maxSize {
+		// the segment being written is never deleted, so close it off to
+		// let it go once it has been acknowledged.
+		if q.writing.written > 0 {
+			if err := q.startSegment(q.writing.id + 1); err != nil {
+				return err
+			}
+		}
+		q.cond.Wait()
+	}
+	if q.writing.written > 0 && q.writing.size+int64(len(record)) > q.segmentSize {
+		if err := q.startSegment(q.writing.id + 1); err != nil {
+			return err
+		}
+	}
+
+	if _, err := q.w.Write(record); err != nil {
+		return fmt.Errorf("unable to write to queue segment: %v", err)
+	}
+	if q.fsync == fsync_Always {
+		if err := q.w.Sync(); err != nil {
+			return fmt.Errorf("unable to sync queue segment: %v", err)
+		}
+	}
+	q.writing.size += int64(len(record))
+	q.writing.written++
+	q.size += int64(len(record))
+	q.cond.Broadcast()
+	return nil
+}
+
+// blocks until a page can be read from the queue.
+func (q *diskQueue) get() eventPage {
+	q.Lock()
+	defer q.Unlock()
+
+	for {
+		if q.reading == nil {
+			if err := q.nextReadSegment(); err != nil {
+				log.Printf("unable to read queue: %v", err)
+				q.cond.Wait()
+				continue
+			}
+		}
+		s := q.reading
+		if !s.closed && len(s.acked) == s.written {
+			q.cond.Wait()
+			continue
+		}
+
+		page, err := readRecord(q.r)
+		if err != nil {
+			if !s.closed {
+				log.Printf("unable to read queue segment %d: %v", s.id, err)
+				q.cond.Wait()
+				continue
+			}
+			if err != io.EOF {
+				log.Printf("queue segment %d is corrupt, skipping the rest of it: %v", s.id, err)
+			}
+			s.drained = true
+			q.r.Close()
+			q.reading, q.r = nil, nil
+			q.collect()
+			continue
+		}
+
+		index := len(s.acked)
+		s.acked = append(s.acked, index < s.skip)
+		if index < s.skip || len(page) == 0 {
+			s.acked[index] = true
+			continue
+		}
+		record := &queueRecord{seg: s, index: index, count: len(page)}
+		for _, e := range page {
+			e.queued = record
+		}
+		return page
+	}
+}
+
+// opens the oldest segment that hasn't been read yet.  Must be called with
+// the lock held.
+func (q *diskQueue) nextReadSegment() error {
+	for _, s := range q.segments {
+		if s.drained {
+			continue
+		}
+		f, err := os.Open(q.segmentPath(s.id))
+		if err != nil {
+			return err
+		}
+		q.reading, q.r = s, f
+		return nil
+	}
+	return fmt.Errorf("no segments to read")
+}
+
+// applies acks to the queue, returning the events that weren't read from it.
+func (q *diskQueue) ack(page eventPage) eventPage {
+	q.Lock()
+	defer q.Unlock()
+
+	var unqueued eventPage
+	for _, e := range page {
+		r := e.queued
+		if r == nil {
+			unqueued = append(unqueued, e)
+			continue
+		}
+		r.acked++
+		if r.acked == r.count {
+			r.seg.acked[r.index] = true
+		}
+	}
+	q.collect()
+	return unqueued
+}
+
+// deletes segments that have been completely read and acknowledged, and
+// records how far into the oldest remaining segment we have been
+// acknowledged.  Must be called with the lock held.
+func (q *diskQueue) collect() {
+	for len(q.segments) > 0 {
+		s := q.segments[0]
+		for s.prefix < len(s.acked) && s.acked[s.prefix] {
+			s.prefix++
+		}
+		if s == q.writing || !s.drained || s.prefix < len(s.acked) {
+			break
+		}
+		if err := os.Remove(q.segmentPath(s.id)); err != nil {
+			log.Printf("unable to remove queue segment: %v", err)
+		}
+		q.size -= s.size
+		q.segments = q.segments[1:]
+		q.cond.Broadcast()
+	}
+
+	if len(q.segments) == 0 {
+		return
+	}
+	oldest := q.segments[0]
+	if oldest.id != q.ackSegment || oldest.prefix != q.ackRecords {
+		q.ackSegment, q.ackRecords = oldest.id, oldest.prefix
+		if err := q.writeAckFile(); err != nil {
+			log.Printf("unable to record queue position: %v", err)
+		}
+	}
+}
+
+// closes the current write segment and starts a new one.  Must be called with
+// the lock held.
+func (q *diskQueue) startSegment(id uint64) error {
+	if q.w != nil {
+		if q.fsync != fsync_Never {
+			if err := q.w.Sync(); err != nil {
+				return fmt.Errorf("unable to sync queue segment: %v", err)
+			}
+		}
+		q.w.Close()
+		q.writing.closed = true
+	}
+	f, err := os.OpenFile(q.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create queue segment: %v", err)
+	}
+	q.w = f
+	q.writing = &segment{id: id}
+	q.segments = append(q.segments, q.writing)
+	q.cond.Broadcast()
+	return nil
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.seg", id))
+}
+
+type queueAck struct {
+	Segment uint64 `json:"segment"`
+	Records int    `json:"records"`
+}
+
+func (q *diskQueue) readAckFile() (uint64, int) {
+	f, err := os.Open(filepath.Join(q.dir, "ack"))
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	var a queueAck
+	if err := json.NewDecoder(f).Decode(&a); err != nil {
+		log.Printf("unable to read queue ack file, replaying everything: %v", err)
+		return 0, 0
+	}
+	return a.Segment, a.Records
+}
+
+func (q *diskQueue) writeAckFile() error {
+	path := filepath.Join(q.dir, "ack")
+	f, err := os.Create(path + ".new")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(queueAck{q.ackSegment, q.ackRecords}); err != nil {
+		return err
+	}
+	if q.fsync == fsync_Always {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(path+".new", path)
+}
+
+// reads a single length-prefixed, checksummed page.
+func readRecord(r io.Reader) (eventPage, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, unexpected(err)
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	var page eventPage
+	if err := json.Unmarshal(data, &page); err != nil {
+		return nil, fmt.Errorf("unable to decode page: %v", err)
+	}
+	return page, nil
+}
+
+type bySegmentId []*segment
+
+func (s bySegmentId) Len() int           { return len(s) }
+func (s bySegmentId) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySegmentId) Less(i, j int) bool { return s[i].id < s[j].id }
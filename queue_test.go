@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func queuePage(offset int64) eventPage {
+	return eventPage{
+		&FileEvent{Source: "/var/log/app.log", Offset: offset, Text: "line"},
+		&FileEvent{Source: "/var/log/app.log", Offset: offset + 5, Text: "line"},
+	}
+}
+
+func TestQueueReplaysUnackedPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lumberjack-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// small segments, so that pages are spread across several files.
+	q, err := openQueue(dir, 1<<20, 300, fsync_Always)
+	if err != nil {
+		t.Fatalf("unable to open queue: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := q.put(queuePage(int64(i * 10))); err != nil {
+			t.Fatalf("unable to queue page: %v", err)
+		}
+	}
+	pages := make([]eventPage, 6)
+	for i := range pages {
+		pages[i] = q.get()
+		if pages[i][0].Offset != int64(i*10) {
+			t.Fatalf("page %d read out of order: offset %d", i, pages[i][0].Offset)
+		}
+	}
+	q.ack(pages[0])
+	q.ack(pages[1])
+	q.ack(pages[2][:1])
+
+	// reopen the queue, as if we had restarted.
+	q, err = openQueue(dir, 1<<20, 300, fsync_Always)
+	if err != nil {
+		t.Fatalf("unable to reopen queue: %v", err)
+	}
+	for i := 2; i < 6; i++ {
+		page := q.get()
+		if page[0].Offset != int64(i*10) {
+			t.Fatalf("expected page at offset %d to be replayed, got %d", i*10, page[0].Offset)
+		}
+		q.ack(page)
+	}
+
+	// everything before the segment we're still reading has been read and
+	// acknowledged, and should be gone.
+	q.Lock()
+	defer q.Unlock()
+	if q.segments[0] != q.reading {
+		t.Errorf("acknowledged segments were not deleted: %d remain", len(q.segments))
+	}
+}
+
+func TestQueueAckPassesThroughUnqueuedEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lumberjack-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := openQueue(dir, 1<<20, 1<<20, fsync_Never)
+	if err != nil {
+		t.Fatalf("unable to open queue: %v", err)
+	}
+	if unqueued := q.ack(queuePage(0)); len(unqueued) != 2 {
+		t.Errorf("expected events that were never queued to be returned, got %d", len(unqueued))
+	}
+}
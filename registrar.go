@@ -3,39 +3,298 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// type progress is the position reached in each file, keyed by the file's
+// inode and device, as given by FileState.key.  A file's path is only the
+// last one it was known by.
 type progress map[string]*FileState
 
+// the version of the envelope the progress file is written in.  Version 1
+// files, and those from before the envelope, were keyed by path.
+const progressVersion = 2
+
+// type progressFile is the envelope the progress file is written in, so that
+// a file cut short or otherwise damaged is noticed, rather than read as if
+// every file were new.  Files written before the envelope are just the map of
+// file states, and are still read.
+type progressFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"` // crc32 of files, in hex
+	Files    json.RawMessage `json:"files"`
+}
+
+// loads the progress file, falling back to the previous generation, kept
+// beside it as path.old, if it can't be read.
 func (p *progress) load(path string) error {
-	f, err := os.Open(path)
+	err := p.loadFile(path)
+	if err == nil {
+		return nil
+	}
+	old := path + ".old"
+	if oerr := p.loadFile(old); oerr != nil {
+		return err
+	}
+	log.Printf("%s; using the previous progress file %s", err.Error(), old)
+	return nil
+}
+
+func (p *progress) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("unable to open progress file: %s", err.Error())
 	}
-	defer f.Close()
+	var env progressFile
+	if err := json.Unmarshal(b, &env); err != nil {
+		return fmt.Errorf("unable to decode progress file %s: %s", path, err.Error())
+	}
+	switch {
+	case env.Version == 0:
+		// written before the envelope.
+		env.Files = b
+	case env.Version > progressVersion:
+		return fmt.Errorf("unable to decode progress file %s: unknown version %d", path, env.Version)
+	case progressChecksum(env.Files) != env.Checksum:
+		return fmt.Errorf("unable to decode progress file %s: checksum mismatch", path)
+	}
 
-	*p = make(progress, 32)
-	if err := json.NewDecoder(f).Decode(p); err != nil {
-		return fmt.Errorf("unable to decode progress file: %s", err.Error())
+	files := make(progress, 32)
+	if err := json.Unmarshal(env.Files, &files); err != nil {
+		return fmt.Errorf("unable to decode progress file %s: %s", path, err.Error())
+	}
+	*p = make(progress, len(files))
+	for key, state := range files {
+		if state.Source == "" {
+			state.Source = key
+		}
+		(*p)[state.key()] = state
 	}
 	return nil
 }
 
-// records positions of files read
-func Registrar(input chan eventPage) {
-	for page := range input {
-		if page.empty() {
+func progressChecksum(files []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(files))
+}
+
+// reads the progress file to merge new progress into.  Returns whether the
+// file was intact, rather than missing, damaged or replaced by its previous
+// generation.
+func (p *progress) loadExisting(path string) bool {
+	if p.loadFile(path) == nil {
+		return true
+	}
+	if err := p.load(path); err != nil {
+		log.Printf("failed to read existing state at path %s: %s", path, err.Error())
+		*p = make(progress, 8)
+	}
+	return false
+}
+
+// records newer progress.  Pages handed back by a failed publisher may be
+// acknowledged after pages read later, so a file's position is only replaced
+// by one that was read after it.
+func (p progress) update(newer progress) {
+	for name, fs := range newer {
+		if old, ok := p[name]; ok && old.seq > fs.seq {
 			continue
 		}
+		p[name] = fs
+	}
+}
 
-		p := page.progress()
+// writes the progress file.  The new file is written and synced beside the
+// old one, then renamed over it, so a crash leaves one or the other whole.
+// With keep, the old one is kept as the previous generation.
+func (p progress) save(path string, keep bool) error {
+	files, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("failed to encode log state: %v", err)
+	}
+	b, err := json.Marshal(progressFile{
+		Version:  progressVersion,
+		Checksum: progressChecksum(files),
+		Files:    files,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode log state: %v", err)
+	}
 
-		log.Printf("registrar received %d events. %s", len(page), page.countString())
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for writing: %s", err)
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write log state to file: %v", err)
+	}
 
-		if err := p.writeFile(options.HistoryPath); err != nil {
+	if err := replaceFile(f.Name(), path, keep); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to move log state file: %v", err)
+	}
+	return nil
+}
+
+// removes the entries for files that no longer exist, once they haven't
+// changed for retention.  A file that isn't at its last known path any more
+// is looked for in the same directory, in case it was renamed.  Entries from
+// before the time of recording was kept are given the current time.  Returns
+// the paths removed.
+func (p progress) prune(retention time.Duration, now time.Time) []string {
+	var removed []string
+	for key, state := range p {
+		if state.Updated == 0 {
+			state.Updated = now.Unix()
+			continue
+		}
+		info, err := os.Stat(state.Source)
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && is_file_same(state.Source, info, state) {
+			continue
+		}
+		if path, _ := findRenamed(state); path != "" {
+			state.Source = path
+			continue
+		}
+		if now.Sub(time.Unix(state.Updated, 0)) >= retention {
+			delete(p, key)
+			removed = append(removed, state.Source)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// how often the registrar prunes the progress file.
+const pruneInterval = time.Hour
+
+type pruneRequest struct {
+	retention time.Duration
+	removed   chan []string
+}
+
+// prune requests from the command port, for the registrar.
+var pruneRequests = make(chan pruneRequest)
+
+// has the registrar prune the progress file, returning the paths removed.
+func pruneProgress(retention time.Duration) ([]string, error) {
+	req := pruneRequest{retention, make(chan []string, 1)}
+	select {
+	case pruneRequests <- req:
+	case <-time.After(5 * time.Second):
+		return nil, fmt.Errorf("the registrar isn't running")
+	}
+	return <-req.removed, nil
+}
+
+// held by the registrar while it writes the progress file.  Shutdown takes it
+// and never gives it back, so we don't exit halfway through a write.
+var registrarLock sync.Mutex
+
+// records positions of files read.  When a file is sent to several network
+// groups, its position only advances once every group has acknowledged it.
+//
+// Progress is gathered in memory, and the progress file written every
+// -progress-flush-interval, or once -progress-flush-pages pages have been
+// acknowledged.  Events only count as acknowledged once the file recording
+// them is written, so a crash in between means they are sent again, never
+// lost.  Once flush is closed, on shutdown, the file is written for every
+// page.
+//
+// Entries for files that are gone are pruned every pruneInterval, once they
+// are older than -progress-retention, and when asked to from the command port.
+func Registrar(input chan eventPage, flush <-chan struct{}) {
+	var state progress
+	intact := state.loadExisting(options.HistoryPath)
+
+	var pending int64 // events recorded in state but not yet written
+	var pages int
+	var pruned bool // entries were removed from state since it was written
+	write := func() {
+		if pending == 0 && !pruned {
+			return
+		}
+		registrarLock.Lock()
+		defer registrarLock.Unlock()
+		if err := state.save(options.HistoryPath, intact); err != nil {
+			// tried again on the next tick or page.
 			log.Printf("unable to write history to file: %s", err.Error())
+			return
+		}
+		intact = true
+		atomic.AddInt64(&unacknowledged, -pending)
+		pending, pages = 0, 0
+		pruned = false
+	}
+	prune := func(retention time.Duration) []string {
+		removed := state.prune(retention, time.Now())
+		if len(removed) > 0 {
+			log.Printf("registrar pruned progress for %d files that are gone", len(removed))
+			pruned = true
+		}
+		return removed
+	}
+	prune(options.ProgressRetention)
+	write()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+
+	var tick <-chan time.Time
+	if options.ProgressFlushInterval > 0 {
+		ticker := time.NewTicker(options.ProgressFlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	draining := options.ProgressFlushInterval <= 0
+	for {
+		select {
+		case page, ok := <-input:
+			if !ok {
+				write()
+				return
+			}
+			page = page.acknowledge()
+			if page.empty() {
+				continue
+			}
+
+			log.Printf("registrar received %d events. %s", len(page), page.countString())
+			state.update(page.progress())
+			pending += int64(len(page))
+			pages++
+			if draining || pages >= options.ProgressFlushPages {
+				write()
+			}
+		case <-tick:
+			write()
+		case <-pruneTicker.C:
+			prune(options.ProgressRetention)
+			write()
+		case req := <-pruneRequests:
+			req.removed <- prune(req.retention)
+			write()
+		case <-flush:
+			draining = true
+			flush = nil
+			write()
 		}
 	}
 }
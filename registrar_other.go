@@ -4,8 +4,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -25,33 +23,29 @@ func loadRegistry(fname string) (map[string]*FileState, error) {
 	return existingState, nil
 }
 
-func (p *progress) writeFile(path string) error {
-	f, err := ioutil.TempFile(options.TempDir, "lumberjack")
-	if err != nil {
-		return fmt.Errorf("failed to create temp file for writing: %s\n", err)
+// moves a newly written progress file into place.  With keep, the file it
+// replaces is kept as path.old.  The directory is synced too, so that the
+// rename survives a crash.
+func replaceFile(tmp, path string, keep bool) error {
+	if keep {
+		old := path + ".old"
+		os.Remove(old)
+		if err := os.Link(path, old); err != nil {
+			log.Printf("unable to keep the previous progress file: %s", err.Error())
+		}
 	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return fmt.Errorf("unable to stat temp file: %s", err.Error())
+	if err := os.Rename(tmp, path); err != nil {
+		return err
 	}
 
-	var existing progress
-	if err := existing.load(path); err != nil {
-		log.Printf("failed to read existing state at path %s: %s", path, err.Error())
-		existing = make(progress, 8)
-	}
-
-	for name, fs := range *p {
-		existing[name] = fs
-	}
-
-	if err := json.NewEncoder(f).Encode(existing); err != nil {
-		return fmt.Errorf("failed to write log state to file: %v", err)
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		log.Printf("unable to sync progress file directory: %s", err.Error())
+		return nil
 	}
-	if err := os.Rename(filepath.Join(options.TempDir, fi.Name()), path); err != nil {
-		return fmt.Errorf("failed to move log state file: %v", err)
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		log.Printf("unable to sync progress file directory: %s", err.Error())
 	}
 	return nil
 }
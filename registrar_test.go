@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// returns the progress recorded for the file last known by path.
+func progressOf(p progress, path string) *FileState {
+	for _, state := range p {
+		if state.Source == path {
+			return state
+		}
+	}
+	return &FileState{Offset: -1}
+}
+
+func TestProgressFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".lumberjack")
+
+	// written as the registrar does, merging into what's already there.
+	write := func(name string, state *FileState) {
+		var p progress
+		intact := p.loadExisting(path)
+		p[name] = state
+		if err := p.save(path, intact); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+	write("1_1", &FileState{Source: "/var/log/a.log", Offset: 10, Inode: 1, Device: 1})
+	write("2_1", &FileState{Source: "/var/log/b.log", Offset: 20, Inode: 2, Device: 1})
+
+	var p progress
+	if err := p.load(path); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if len(p) != 2 || p["1_1"].Offset != 10 || p["2_1"].Offset != 20 {
+		t.Errorf("expected both files' progress, got %v", p)
+	}
+
+	// a file cut short, or with a bad checksum, falls back to the previous
+	// generation.
+	b, _ := ioutil.ReadFile(path)
+	for _, damaged := range [][]byte{b[:len(b)/2], bytes.Replace(b, []byte(`"offset":20`), []byte(`"offset":21`), 1)} {
+		ioutil.WriteFile(path, damaged, 0644)
+		p = nil
+		if err := p.load(path); err != nil {
+			t.Fatalf("load of damaged file failed: %v", err)
+		}
+		if len(p) != 1 || p["1_1"].Offset != 10 {
+			t.Errorf("expected the previous generation, got %v", p)
+		}
+	}
+
+	// writing over a damaged file keeps the previous generation.
+	write("2_1", &FileState{Source: "/var/log/b.log", Offset: 20, Inode: 2, Device: 1})
+	p = nil
+	if err := p.loadFile(path + ".old"); err != nil || len(p) != 1 {
+		t.Errorf("expected the previous generation to be kept, got %v (%v)", p, err)
+	}
+
+	// progress files from before the envelope, keyed by path, are still read.
+	ioutil.WriteFile(path, []byte(`{"/var/log/c.log":{"source":"/var/log/c.log","offset":30,"inode":3,"device":1}}`), 0644)
+	p = nil
+	if err := p.load(path); err != nil || p["3_1"].Offset != 30 {
+		t.Errorf("expected old progress file to be read, got %v (%v)", p, err)
+	}
+}
+
+func TestRegistrarBatching(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := options
+	defer func() { options = saved }()
+	options.HistoryPath = filepath.Join(dir, ".lumberjack")
+	options.ProgressFlushInterval = time.Hour
+	options.ProgressFlushPages = 2
+
+	file := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(file, []byte("line\n"), 0644)
+	info, _ := os.Stat(file)
+	page := func(offset int64) eventPage {
+		atomic.AddInt64(&unacknowledged, 1)
+		return eventPage{&FileEvent{Source: file, Offset: offset, Text: "line", fileinfo: info, dests: 1}}
+	}
+	recorded := func() int64 {
+		time.Sleep(50 * time.Millisecond)
+		var p progress
+		if err := p.loadFile(options.HistoryPath); err != nil {
+			return -1
+		}
+		return progressOf(p, file).Offset
+	}
+
+	input := make(chan eventPage)
+	flush := make(chan struct{})
+	go Registrar(input, flush)
+	defer close(input)
+
+	input <- page(0)
+	if offset := recorded(); offset != -1 {
+		t.Errorf("progress file written after one page, at offset %d", offset)
+	}
+	input <- page(5)
+	if offset := recorded(); offset != 10 {
+		t.Errorf("expected progress file written at offset 10 after two pages, got %d", offset)
+	}
+	input <- page(10)
+	if offset := recorded(); offset != 10 {
+		t.Errorf("progress file written early, at offset %d", offset)
+	}
+	close(flush)
+	if offset := recorded(); offset != 15 {
+		t.Errorf("expected progress file written at offset 15 on shutdown, got %d", offset)
+	}
+}
+
+func TestRegistrarRetry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := options
+	defer func() { options = saved }()
+	// the progress file can't be written until its directory is created.
+	options.HistoryPath = filepath.Join(dir, "missing", ".lumberjack")
+	options.ProgressFlushInterval = 50 * time.Millisecond
+	options.ProgressFlushPages = 1
+
+	file := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(file, []byte("line\n"), 0644)
+	info, _ := os.Stat(file)
+	before := atomic.LoadInt64(&unacknowledged)
+	atomic.AddInt64(&unacknowledged, 1)
+
+	input := make(chan eventPage)
+	go Registrar(input, make(chan struct{}))
+	defer close(input)
+	input <- eventPage{&FileEvent{Source: file, Offset: 0, Text: "line", fileinfo: info, dests: 1}}
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&unacknowledged) - before; n != 1 {
+		t.Errorf("expected the event to stay unacknowledged while the file can't be written, got %d", n)
+	}
+	os.Mkdir(filepath.Dir(options.HistoryPath), 0755)
+	time.Sleep(100 * time.Millisecond)
+	var p progress
+	if err := p.loadFile(options.HistoryPath); err != nil || progressOf(p, file).Offset != 5 {
+		t.Errorf("expected the write to be retried, got %v (%v)", p, err)
+	}
+	if n := atomic.LoadInt64(&unacknowledged) - before; n != 0 {
+		t.Errorf("expected the event acknowledged once written, got %d", n)
+	}
+}
+
+func TestProgressUpdateOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(file, []byte("line\n"), 0644)
+	info, _ := os.Stat(file)
+	page := func(offset int64) eventPage {
+		e := &FileEvent{Source: file, Offset: offset, Text: "line", fileinfo: info}
+		fanout{}.send(e, nil)
+		atomic.AddInt64(&unacknowledged, -1)
+		return eventPage{e}
+	}
+
+	// a page requeued from a failed server is acknowledged after the page
+	// read after it.
+	requeued, later := page(0), page(5)
+	p := make(progress)
+	p.update(later.progress())
+	p.update(requeued.progress())
+	if offset := progressOf(p, file).Offset; offset != 10 {
+		t.Errorf("expected offset 10 from the later page, got %d", offset)
+	}
+
+	// a file truncated and read again from the start moves back.
+	again := page(0)
+	p.update(again.progress())
+	if offset := progressOf(p, file).Offset; offset != 5 {
+		t.Errorf("expected offset 5 after the file was read again, got %d", offset)
+	}
+}
+
+func TestProgressPrune(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	day := int64(24 * 60 * 60)
+
+	p := make(progress)
+	for _, name := range []string{"live", "renamed", "new"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte("line\n"), 0644)
+		info, _ := os.Stat(path)
+		state := &FileState{Source: path, Updated: now.Unix() - 2*day}
+		state.Inode, state.Device = file_ids(info)
+		p[state.key()] = state
+	}
+	progressOf(p, filepath.Join(dir, "new")).Updated = 0
+	os.Rename(filepath.Join(dir, "renamed"), filepath.Join(dir, "renamed.1"))
+	p["1_1"] = &FileState{Source: filepath.Join(dir, "gone"), Updated: now.Unix() - 2*day}
+	p["2_1"] = &FileState{Source: filepath.Join(dir, "recent"), Updated: now.Unix() - 60}
+
+	removed := p.prune(24*time.Hour, now)
+	if want := []string{filepath.Join(dir, "gone")}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("expected %v pruned, got %v", want, removed)
+	}
+	if len(p) != 4 || progressOf(p, filepath.Join(dir, "new")).Updated != now.Unix() {
+		t.Errorf("expected live, renamed, new and recent to be kept, with new given the current time, got %v", p)
+	}
+	if progressOf(p, filepath.Join(dir, "renamed.1")).Offset == -1 {
+		t.Errorf("expected the renamed file's progress to be found under its new name")
+	}
+}
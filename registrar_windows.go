@@ -1,24 +1,19 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
 	"os"
 )
 
-func (p *progress) writeFile(path string) error {
-	tmp := path + ".new"
-	file, err := os.Create(tmp)
-	if err != nil {
-		return fmt.Errorf("unable to write progress to file: %s", err.Error())
-	}
-
-	encoder := json.NewEncoder(file)
-	encoder.Encode(state)
-	file.Close()
-
+// moves a newly written progress file into place.  With keep, the file it
+// replaces is kept as path.old.  Windows can't rename over a file, so there's
+// a moment with no progress file at path, when loading falls back to path.old.
+func replaceFile(tmp, path string, keep bool) error {
 	old := path + ".old"
-	os.Rename(path, old)
-	os.Rename(tmp, path)
+	if keep {
+		os.Remove(old)
+		os.Rename(path, old)
+	} else {
+		os.Remove(path)
+	}
+	return os.Rename(tmp, path)
 }
@@ -12,11 +12,22 @@ import (
 
 type fileId string
 
+// the number of lines dropped by filters and codecs, by file.
+var droppedLines = expvar.NewMap("dropped")
+
 type hregistry struct {
 	sync.RWMutex
 	RunningIds   map[fileId]*Harvester `json:"by_id"`
 	RunningPaths map[string]*Harvester `json:"by_path"`
 	paths        map[string]bool
+	inactive     map[string]inactiveFile // files closed for inactivity, by path
+}
+
+// type inactiveFile is where a harvester closed an inactive file.
+type inactiveFile struct {
+	offset int64  // where to resume reading from
+	size   int64  // the file's size when it was closed
+	tail   []byte // the last bytes read, ending at offset
 }
 
 func newRegistry(conf *Config) *hregistry {
@@ -24,6 +35,7 @@ func newRegistry(conf *Config) *hregistry {
 		RunningIds:   make(map[fileId]*Harvester, len(conf.Files)),
 		RunningPaths: make(map[string]*Harvester, len(conf.Files)),
 		paths:        make(map[string]bool, len(conf.Files)),
+		inactive:     make(map[string]inactiveFile),
 	}
 	for _, f := range conf.Files {
 		for _, path := range f.Paths {
@@ -34,7 +46,7 @@ func newRegistry(conf *Config) *hregistry {
 	return r
 }
 
-func (r hregistry) String() string {
+func (r *hregistry) String() string {
 	r.RLock()
 	defer r.RUnlock()
 
@@ -50,7 +62,7 @@ func (r hregistry) String() string {
 	return buf.String()
 }
 
-func (r hregistry) register(v *Harvester) error {
+func (r *hregistry) register(v *Harvester) error {
 	r.Lock()
 	defer r.Unlock()
 
@@ -63,9 +75,15 @@ func (r hregistry) register(v *Harvester) error {
 		return fmt.Errorf("file is already being harvested: %v", v)
 	}
 
-	if _, ok := r.RunningPaths[v.Path]; ok {
-		return fmt.Errorf("path is already being harvested: %v", v)
-
+	if h, ok := r.RunningPaths[v.Path]; ok {
+		if info, err := os.Stat(v.Path); err != nil || !os.SameFile(info, v.fi) {
+			return fmt.Errorf("path is already being harvested: %v", v)
+		}
+		// the file h is reading was rotated away without us seeing it
+		// renamed.  h keeps reading it, but no longer owns the path.
+		log.Printf("file at %s was replaced; the old one is still being read", v.Path)
+		h.moved = true
+		delete(r.RunningPaths, v.Path)
 	}
 	r.RunningIds[id] = v
 	r.RunningPaths[v.Path] = v
@@ -74,7 +92,7 @@ func (r hregistry) register(v *Harvester) error {
 	return nil
 }
 
-func (r hregistry) unregister(v *Harvester) error {
+func (r *hregistry) unregister(v *Harvester) error {
 	r.Lock()
 	defer r.Unlock()
 
@@ -87,24 +105,23 @@ func (r hregistry) unregister(v *Harvester) error {
 		return fmt.Errorf("unable to unregister harvester: id %s wasn't registered", id)
 	}
 
-	if _, ok := r.RunningPaths[v.Path]; !ok {
-		return fmt.Errorf("unable to unregister harvester: path %s wasn't registered", v.Path)
-	}
 	delete(r.RunningIds, id)
-	delete(r.RunningPaths, v.Path)
+	if r.RunningPaths[v.Path] == v {
+		delete(r.RunningPaths, v.Path)
+	}
 
 	log.Printf("registrar unregistered: %v", v)
 	return nil
 }
 
-func (r hregistry) byPath(path string) *Harvester {
+func (r *hregistry) byPath(path string) *Harvester {
 	r.RLock()
 	defer r.RUnlock()
 
 	return r.RunningPaths[path]
 }
 
-func (r hregistry) byPathStat(path string) *Harvester {
+func (r *hregistry) byPathStat(path string) *Harvester {
 	fi, err := os.Stat(path)
 	if err != nil {
 		log.Printf("registry can't stat file: %v", err)
@@ -113,14 +130,14 @@ func (r hregistry) byPathStat(path string) *Harvester {
 	return r.byId(filestring(fi))
 }
 
-func (r hregistry) byId(id fileId) *Harvester {
+func (r *hregistry) byId(id fileId) *Harvester {
 	r.RLock()
 	defer r.RUnlock()
 
 	return r.RunningIds[id]
 }
 
-func (r hregistry) rename(prev, curr string) {
+func (r *hregistry) rename(prev, curr string) {
 	r.Lock()
 	defer r.Unlock()
 
@@ -141,3 +158,41 @@ func (r hregistry) rename(prev, curr string) {
 	r.RunningPaths[curr] = h
 	delete(r.RunningPaths, prev)
 }
+
+// records the offset at which a harvester closed an inactive file, the
+// file's size at the time, and the last bytes read from it.
+func (r *hregistry) deactivate(path string, offset, size int64, tail []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.inactive[path] = inactiveFile{offset, size, tail}
+}
+
+// checks whether a file closed for inactivity has changed size since.  If it
+// has, it is no longer considered inactive, and the offset to resume from is
+// returned.  A file that has shrunk, or no longer has the bytes last read
+// before the offset, was truncated and written to again, and resumes from the
+// start.
+func (r *hregistry) reopen(path string, size int64) (int64, bool) {
+	r.Lock()
+	f, ok := r.inactive[path]
+	if !ok || size == f.size {
+		r.Unlock()
+		return 0, false
+	}
+	delete(r.inactive, path)
+	r.Unlock()
+
+	if size < f.size || !hasTail(path, f.offset, f.tail) {
+		return 0, true
+	}
+	return f.offset, true
+}
+
+// forgets a file closed for inactivity, since it has been replaced.
+func (r *hregistry) forget(path string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.inactive, path)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// type pipeline is everything started from the configuration: a prospector
+// for every FileConfig, and a spooler and publishers for every NetworkGroup.
+// Reloading the configuration applies a new one to the running pipeline.
+//
+// A network group's channels and spooler live as long as the process does,
+// so pages that are spooled or in flight survive a reload.  Only the
+// publishers are replaced, when the group's settings change.  Likewise,
+// prospectors are only started and stopped for FileConfig entries that were
+// added or removed, and new harvesters resume from the progress file, so
+// nothing is read again from the start.
+type pipeline struct {
+	sync.Mutex
+	config    *Config
+	registrar chan eventPage
+	flush     chan struct{} // closed on shutdown, to flush the spoolers
+
+	groups      map[string]NetworkGroup   // every group ever started, by name
+	acked       map[string]chan eventPage // where each group's publishers hand acknowledged pages
+	dispatchers map[string]*dispatcher
+	prospectors map[string]*stopper // prospectors and inputs, by FileConfig json
+}
+
+// the pipeline started by main.
+var running *pipeline
+
+func newPipeline(registrar chan eventPage) *pipeline {
+	return &pipeline{
+		registrar:   registrar,
+		flush:       make(chan struct{}),
+		groups:      make(map[string]NetworkGroup),
+		acked:       make(map[string]chan eventPage),
+		dispatchers: make(map[string]*dispatcher),
+		prospectors: make(map[string]*stopper),
+	}
+}
+
+// applies a configuration to the pipeline.  The configuration's network
+// groups are modified to share the channels of the groups already running.
+func (p *pipeline) apply(conf *Config) error {
+	p.Lock()
+	defer p.Unlock()
+
+	for name, group := range conf.Network {
+		if old, ok := p.groups[name]; ok {
+			group.c_events = old.c_events
+			group.c_pages_unsent = old.c_pages_unsent
+			conf.Network[name] = group
+		}
+		if d, ok := p.dispatchers[name]; ok && d.same(group) {
+			continue
+		}
+		// catch bad TLS settings before anything is torn down.
+		if _, err := group.TLS(); err != nil {
+			return fmt.Errorf("unable to apply config: network group %s: %v", name, err)
+		}
+	}
+
+	for name, group := range conf.Network {
+		if _, ok := p.groups[name]; !ok {
+			acked, err := group.Spool(p.registrar, p.flush)
+			if err != nil {
+				return fmt.Errorf("unable to apply config: %v", err)
+			}
+			p.groups[name] = group
+			p.acked[name] = acked
+		}
+
+		d, ok := p.dispatchers[name]
+		if ok {
+			if d.same(group) {
+				continue
+			}
+			log.Printf("restarting publishers for network group %s", name)
+			d.stop()
+		}
+		d, err := startPublishers(group, p.acked[name])
+		if err != nil {
+			return fmt.Errorf("unable to apply config: %v", err)
+		}
+		p.dispatchers[name] = d
+	}
+	if p.config != nil {
+		for name := range p.config.Network {
+			if _, ok := conf.Network[name]; !ok {
+				log.Printf("network group %s removed from config; its publishers will keep sending what it has already spooled", name)
+			}
+		}
+	}
+
+	// what to run for each files and inputs entry, by its json
+	wanted := make(map[string]func(*stopper), len(conf.Files)+len(conf.Inputs))
+	for _, fileconfig := range conf.Files {
+		fc := fileconfig
+		wanted[fc.raw] = func(s *stopper) { Prospect(fc, conf.Network, s) }
+	}
+	for _, input := range conf.Inputs {
+		in := input
+		wanted[in.raw] = func(s *stopper) { Listen(in, conf.Network, s) }
+	}
+	for key, s := range p.prospectors {
+		if _, ok := wanted[key]; !ok {
+			log.Printf("stopping prospector: %s", key)
+			if !s.stop(options.ShutdownTimeout) {
+				log.Printf("prospector %s didn't stop cleanly; some lines may be sent again", key)
+				// its aborted harvesters have to unregister their files
+				// before another prospector can read them.
+				if !s.wait(options.ShutdownTimeout) {
+					log.Printf("prospector %s is still running; its files may not be read again until restart", key)
+				}
+			}
+			delete(p.prospectors, key)
+		}
+	}
+	for key, run := range wanted {
+		if _, ok := p.prospectors[key]; ok {
+			continue
+		}
+		s := newStopper()
+		run := run
+		s.spawn(func() { run(s) })
+		p.prospectors[key] = s
+	}
+
+	p.config = conf
+	return nil
+}
+
+// returns the configuration last applied.
+func (p *pipeline) current() *Config {
+	p.Lock()
+	defer p.Unlock()
+	return p.config
+}
+
+// shuts the pipeline down in an orderly fashion: prospectors and harvesters
+// are stopped, the lines they have read are flushed through the spoolers, and
+// we wait until the registrar has recorded everything as acknowledged.  Gives
+// up once timeout has passed.  The pipeline can't be used afterwards.
+func (p *pipeline) drain(timeout time.Duration) {
+	p.Lock()
+	deadline := time.Now().Add(timeout)
+
+	var wg sync.WaitGroup
+	for key, s := range p.prospectors {
+		wg.Add(1)
+		go func(key string, s *stopper) {
+			defer wg.Done()
+			if !s.stop(deadline.Sub(time.Now())) {
+				log.Printf("prospector %s didn't stop in time", key)
+			}
+		}(key, s)
+	}
+	wg.Wait()
+	close(p.flush)
+
+	for atomic.LoadInt64(&unacknowledged) > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&unacknowledged); n > 0 {
+		log.Printf("gave up waiting for %d unacknowledged events; they will be read again on restart", n)
+	}
+
+	// keep the registrar from starting another write.
+	registrarLock.Lock()
+}
+
+// re-reads the config file and applies it to the running pipeline.
+func reloadConfig() error {
+	conf, err := LoadConfig(options.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("unable to reload config: %v", err)
+	}
+	if len(conf.Files) == 0 && len(conf.Inputs) == 0 {
+		return fmt.Errorf("unable to reload config: no paths or inputs given")
+	}
+	log.Printf("reloading config from %s", options.ConfigFile)
+	return running.apply(conf)
+}
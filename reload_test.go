@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writes a config file with the given network and files sections, and loads
+// it.
+func loadTestConfig(t *testing.T, dir, network string, files ...string) *Config {
+	path := filepath.Join(dir, "lumberjack.conf")
+	conf := fmt.Sprintf(`{"network": %s, "files": [%s]}`, network, strings.Join(files, ","))
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatalf("unable to write config: %v", err)
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	return c
+}
+
+func TestPipelineApply(t *testing.T) {
+	startWatching(t)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := options
+	defer func() { options = saved }()
+	options.SpoolSize = 1
+	options.ShutdownTimeout = 100 * time.Millisecond
+
+	// no servers, so nothing is ever sent and harvesters soon block.
+	network := `{"servers": [], "timeout": 1}`
+	entry := func(name, typ string) string {
+		return fmt.Sprintf(`{"paths": [%q], "fields": {"type": %q}, "start_position": "beginning", "scan_interval": 60}`,
+			filepath.Join(dir, name), typ)
+	}
+	for _, name := range []string{"a.log", "b.log", "c.log"} {
+		for i := 0; i < 50; i++ {
+			appendLines(t, filepath.Join(dir, name), fmt.Sprintf("%s %d", name, i))
+		}
+	}
+
+	p := newPipeline(make(chan eventPage, 16))
+	first := loadTestConfig(t, dir, network, entry("a.log", "a"), entry("b.log", "b"))
+	if err := p.apply(first); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	a, b := p.prospectors[first.Files[0].raw], p.prospectors[first.Files[1].raw]
+	d, events := p.dispatchers["default"], first.Network["default"].c_events
+	if a == nil || b == nil || d == nil {
+		t.Fatalf("expected prospectors and publishers to be started, got %v and %v", p.prospectors, p.dispatchers)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// an unchanged entry keeps its prospector, a changed one is replaced,
+	// and an unchanged network group keeps its channels and publishers.
+	second := loadTestConfig(t, dir, network, entry("a.log", "a"), entry("b.log", "b2"), entry("c.log", "c"))
+	if err := p.apply(second); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if len(p.prospectors) != 3 || p.prospectors[second.Files[0].raw] != a || p.prospectors[second.Files[1].raw] == b {
+		t.Errorf("expected a kept, b replaced and c added, got %v", p.prospectors)
+	}
+	if p.dispatchers["default"] != d || second.Network["default"].c_events != events {
+		t.Errorf("expected the unchanged network group to be kept")
+	}
+
+	// b's old harvester was aborted, so the new one reads the file.
+	time.Sleep(200 * time.Millisecond)
+	if h := registry.byPath(filepath.Join(dir, "b.log")); h == nil || h.Fields["type"] != "b2" {
+		t.Errorf("expected b.log to be read by the new prospector, got %v", h)
+	}
+
+	// changed settings restart the publishers, but keep the channels.
+	third := loadTestConfig(t, dir, `{"servers": [], "timeout": 2}`, entry("a.log", "a"))
+	if err := p.apply(third); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if p.dispatchers["default"] == d || third.Network["default"].c_events != events {
+		t.Errorf("expected the publishers restarted, with the same channels")
+	}
+	d = p.dispatchers["default"]
+
+	// bad TLS settings are rejected before anything changes.
+	bad := loadTestConfig(t, dir, fmt.Sprintf(`{"servers": [], "ssl ca": %q}`, filepath.Join(dir, "missing.crt")))
+	if err := p.apply(bad); err == nil {
+		t.Errorf("expected a missing CA to be rejected")
+	}
+	if p.current() != third || p.dispatchers["default"] != d || len(p.prospectors) != 1 {
+		t.Errorf("expected nothing to change after a rejected config")
+	}
+}
+
+func TestPipelineDrain(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	saved := options
+	defer func() { options = saved }()
+	options.HistoryPath = filepath.Join(dir, ".lumberjack")
+	options.ProgressFlushInterval = time.Hour
+	options.ProgressFlushPages = 100
+	others := atomic.SwapInt64(&unacknowledged, 0)
+	defer atomic.AddInt64(&unacknowledged, others)
+
+	file := filepath.Join(dir, "app.log")
+	appendLines(t, file, "first", "second")
+	info, _ := os.Stat(file)
+
+	var mu sync.Mutex
+	var steps []string
+	step := func(s string) {
+		mu.Lock()
+		steps = append(steps, s)
+		mu.Unlock()
+	}
+
+	registrar := make(chan eventPage)
+	p := newPipeline(registrar)
+	go Registrar(registrar, p.flush)
+
+	// a prospector that has read two lines, and one that was abandoned by
+	// both of its destinations.
+	events := make(chan *FileEvent, 4)
+	out := fanout{events}
+	out.send(&FileEvent{Source: file, Offset: 0, Text: "first", fileinfo: info}, nil)
+	out.send(&FileEvent{Source: file, Offset: 6, Text: "second", fileinfo: info}, nil)
+	dropped := &FileEvent{Source: file, Offset: 13, Text: "third", fileinfo: info}
+	fanout{make(chan *FileEvent, 1), make(chan *FileEvent, 1)}.send(dropped, nil)
+	dropped.drop()
+	dropped.drop()
+
+	s := newStopper()
+	s.spawn(func() {
+		<-s.stopping()
+		time.Sleep(50 * time.Millisecond)
+		step("prospectors stopped")
+	})
+	p.prospectors["app"] = s
+
+	// a spooler that only sends what it has once flushed.
+	go func() {
+		<-p.flush
+		step("flushed")
+		registrar <- eventPage{<-events, <-events}
+	}()
+
+	p.drain(time.Second)
+	defer registrarLock.Unlock()
+
+	if fmt.Sprint(steps) != "[prospectors stopped flushed]" {
+		t.Errorf("expected prospectors stopped before flushing, got %v", steps)
+	}
+	if n := atomic.LoadInt64(&unacknowledged); n != 0 {
+		t.Errorf("expected no unacknowledged events, got %d", n)
+	}
+	var prog progress
+	if err := prog.loadFile(options.HistoryPath); err != nil || progressOf(prog, file).Offset != 13 {
+		t.Errorf("expected the final progress written at offset 13, got %v (%v)", prog, err)
+	}
+}
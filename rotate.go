@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Rotated files are told apart from new ones by their inodes and sizes, not
+// their names: a renamed file keeps its inode, so its harvester follows it,
+// and a file copied and truncated shrinks below what we've read of it, or no
+// longer holds the bytes we last read.  Names are only used to keep
+// prospectors from starting harvesters for the rotated copies of files they
+// already read.
+
+// suffixes logrotate adds to rotated files, besides those configured.
+var rotateSuffixes = patternList{
+	regexp.MustCompile(`\.\d+(\.gz|\.bz2)?$`),  // numeric suffix (default suffix)
+	regexp.MustCompile(`-\d{8}(\.gz|\.bz2)?$`), // dateext option
+}
+
+// the most bytes kept of what was last read from a file, to recognise its
+// copy by.
+const tailSize = 256
+
+// the most bytes of a file's last line kept in the progress file, to
+// recognise it by after a restart.
+const progressTailSize = 64
+
+// strips a path of a rotation suffix, either logrotate's or one of extra.
+func rotatedBase(path string, extra patternList) (string, bool) {
+	for _, suffixes := range []patternList{rotateSuffixes, extra} {
+		for _, re := range suffixes {
+			if loc := re.FindStringIndex(path); loc != nil && loc[0] > 0 {
+				return path[:loc[0]], true
+			}
+		}
+	}
+	return path, false
+}
+
+// reports whether file is named as a rotation of a file that's already being
+// read, so its lines have been or will be read under the original's name.
+func isRotation(file string, conf *FileConfig, fileinfo map[string]os.FileInfo) bool {
+	base, ok := rotatedBase(file, conf.RotateSuffixes)
+	if !ok {
+		return false
+	}
+	if _, known := fileinfo[base]; known {
+		return true
+	}
+	return registry.byPath(base) != nil
+}
+
+// reports whether the file at path is one of the entry's, or a rotation of
+// one of them.
+func (f *FileConfig) owns(path string) bool {
+	if f.ExcludePaths.match(path) {
+		return false
+	}
+	base, _ := rotatedBase(path, f.RotateSuffixes)
+	for _, glob := range f.Paths {
+		if globMatch(glob, path) || globMatch(glob, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// looks in the directory a file was last known in for the file under another
+// name, as when it was rotated.  Returns "" if it isn't there.
+func findRenamed(state *FileState) (string, os.FileInfo) {
+	dir := filepath.Dir(state.Source)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", nil
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if path != state.Source && info.Mode().IsRegular() && is_file_same(path, info, state) && readTo(path, info, state) {
+			return path, info
+		}
+	}
+	return "", nil
+}
+
+// reports whether the file at path could be the one whose progress is state:
+// it's at least as long as what was read of it, and the bytes before the
+// offset are the ones last read.  A new file given the inode of one that was
+// deleted usually isn't, so it isn't mistaken for the old one and read from
+// part way through.
+func readTo(path string, info os.FileInfo, state *FileState) bool {
+	return info.Size() >= state.Offset && hasTail(path, state.Offset, []byte(state.Tail))
+}
+
+// keeps the last bytes read from the file.
+func (h *Harvester) remember(b []byte) {
+	h.tail = append(h.tail, b...)
+	if len(h.tail) > tailSize {
+		h.tail = append(h.tail[:0], h.tail[len(h.tail)-tailSize:]...)
+	}
+}
+
+// reads the bytes before offset, when starting to read part way through the
+// file.
+func (h *Harvester) loadTail(offset int64) {
+	n := int64(tailSize)
+	if offset < n {
+		n = offset
+	}
+	tail := make([]byte, n)
+	if _, err := h.file.ReadAt(tail, offset-n); err != nil {
+		log.Printf("unable to read the end of what was read of %s: %v", h.path(), err)
+		return
+	}
+	h.tail = tail
+}
+
+// reports whether the bytes before offset are no longer the last ones we
+// read, as when the file is truncated and written to again before we notice
+// it shrink.
+func (h *Harvester) rewritten(offset int64) bool {
+	if len(h.tail) == 0 {
+		return false
+	}
+	b := make([]byte, len(h.tail))
+	if _, err := h.file.ReadAt(b, offset-int64(len(b))); err != nil {
+		return false
+	}
+	return !bytes.Equal(b, h.tail)
+}
+
+// looks for a copy of the harvester's file made just before it was truncated,
+// as by logrotate's copytruncate, so that lines written after our last read
+// aren't lost.  A copy is another file in the same directory at least offset
+// bytes long, whose bytes before offset are the last ones we read.  If we
+// haven't read anything, only files named as rotations of ours will do.
+// Returns the newest copy, or "" if there isn't one.
+func (h *Harvester) findCopy(offset int64) string {
+	dir := filepath.Dir(h.path())
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("unable to look for a copy of truncated file %s: %v", h.path(), err)
+		return ""
+	}
+
+	var found string
+	var newest time.Time
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if !info.Mode().IsRegular() || info.Size() < offset || info.ModTime().Before(newest) {
+			continue
+		}
+		if h.fi != nil && os.SameFile(info, h.fi) {
+			continue
+		}
+		if len(h.tail) == 0 {
+			base, ok := rotatedBase(path, h.conf.RotateSuffixes)
+			if !ok || base != filepath.Clean(h.path()) {
+				continue
+			}
+		} else if !hasTail(path, offset, h.tail) {
+			continue
+		}
+		found, newest = path, info.ModTime()
+	}
+	return found
+}
+
+// reports whether the bytes before offset in the file at path are tail.
+func hasTail(path string, offset int64, tail []byte) bool {
+	if len(tail) == 0 {
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	b := make([]byte, len(tail))
+	if _, err := f.ReadAt(b, offset-int64(len(b))); err != nil {
+		return false
+	}
+	return bytes.Equal(b, tail)
+}
+
+// starts a harvester to read the rest of a truncated file's copy, from the
+// offset we had read the original up to.  It stops at the end of the copy.
+func (h *Harvester) readCopy(path string, offset int64) {
+	log.Printf("file %s was copied to %s before being truncated; reading the rest from there", h.path(), path)
+	c := newHarvester(path, h.conf, h.out, h.stop)
+	c.moved = true
+	c.drain = true
+	h.stop.spawn(func() { c.Harvest(offset, 0) })
+}
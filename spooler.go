@@ -4,11 +4,14 @@ import (
 	"time"
 )
 
-// buffers events until ready to flush to the publisher
+// buffers events until ready to flush to the publisher.  Once flush is
+// closed, as it is on shutdown, events are passed on as soon as the input is
+// empty rather than waiting for the spool to fill.
 func Spool(input chan *FileEvent,
 	output chan eventPage,
 	max_size uint64,
-	idle_timeout time.Duration) {
+	idle_timeout time.Duration,
+	flush <-chan struct{}) {
 	// heartbeat periodically. If the last flush was longer than
 	// 'idle_timeout' time ago, then we'll force a flush to prevent us from
 	// holding on to spooled events for too long.
@@ -22,20 +25,32 @@ func Spool(input chan *FileEvent,
 	// Current write position in the spool
 	var spool_i int = 0
 
+	// set once flush is closed
+	draining := false
+
 	next_flush_time := time.Now().Add(idle_timeout)
 	for {
 		select {
+		case <-flush:
+			flush = nil
+			draining = true
+			if spool_i > 0 {
+				var spoolcopy []*FileEvent
+				spoolcopy = append(spoolcopy, spool[0:spool_i]...)
+				output <- spoolcopy
+				spool_i = 0
+			}
 		case event := <-input:
 			//append(spool, event)
 			spool[spool_i] = event
 			spool_i++
 
-			// Flush if full
-			if spool_i == cap(spool) {
+			// Flush if full, or if draining and nothing else is waiting
+			if spool_i == cap(spool) || (draining && len(input) == 0) {
 				//spoolcopy := make([]*FileEvent, max_size)
 				var spoolcopy []*FileEvent
 				//fmt.Println(spool[0])
-				spoolcopy = append(spoolcopy, spool[:]...)
+				spoolcopy = append(spoolcopy, spool[0:spool_i]...)
 
 				output <- spoolcopy
 				next_flush_time = time.Now().Add(idle_timeout)
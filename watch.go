@@ -3,43 +3,18 @@ package main
 import (
 	"code.google.com/p/go.exp/inotify"
 	"log"
-	"regexp"
-	"strings"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
 var (
-	watcher   *inotify.Watcher
-	watchDirs = make(map[string]bool)
-	watchLock sync.Mutex
-
-	lr_suffixes = []*regexp.Regexp{
-		regexp.MustCompile("\\.\\d+$"), // numeric suffix (default sufix)
-		regexp.MustCompile("-\\d{8}$"), // dateext option
-	}
+	watcher     *inotify.Watcher
+	watchDirs   = make(map[string]bool)
+	globWatches = make(map[*globWatch]bool)
+	watchLock   sync.Mutex
 )
 
-// strips a path name of logrotate suffixes.
-func lrStrip(path string) (string, bool) {
-	for _, p := range lr_suffixes {
-		if indices := p.FindStringIndex(path); indices != nil {
-			return path[:indices[0]], true
-		}
-	}
-	return path, false
-}
-
-func copyTruncate(fullPath string) {
-	path, ok := lrStrip(fullPath)
-	if !ok {
-		return
-	}
-	h := registry.byPath(path)
-	if h != nil {
-		h.nextPath = fullPath
-	}
-}
-
 func reportFSEvents() {
 	defer func() {
 		log.Println("reportFSEvents ending")
@@ -57,15 +32,30 @@ func reportFSEvents() {
 					break
 				}
 
-				if strings.Contains(prev.Name, "logrotate_temp") {
-					copyTruncate(ev.Name)
-				} else {
-					registry.rename(prev.Name, ev.Name)
-				}
+				registry.rename(prev.Name, ev.Name)
 				delete(cookies, ev.Cookie)
 
+			case ev.Mask&(inotify.IN_MODIFY|inotify.IN_CLOSE_WRITE) > 0:
+				// files in the working directory are watched as ./name
+				h := registry.byPath(ev.Name)
+				if h == nil {
+					h = registry.byPath(filepath.Clean(ev.Name))
+				}
+				if h != nil {
+					h.notify()
+				}
+
 			case ev.Mask&inotify.IN_DELETE > 0:
+				// the harvester sends what's left in the file, then sees
+				// that it's gone.
+				registry.forget(ev.Name)
+				if h := registry.byPath(ev.Name); h != nil {
+					h.notify()
+				}
+
 			case ev.Mask&inotify.IN_CREATE > 0:
+				fileCreated(ev.Name, ev.Mask&inotify.IN_ISDIR > 0)
+
 			default:
 				log.Printf("unknown: %v (%v)", ev, ev.Cookie)
 			}
@@ -75,15 +65,136 @@ func reportFSEvents() {
 	}
 }
 
-func watchDir(path string) {
+// watches a directory for files being created, deleted, moved and written
+// to.  Returns false if the directory can't be watched, in which case
+// harvesters in it poll for new lines.
+func watchDir(path string) bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+
+	if watcher == nil {
+		return false
+	}
 	if !watchDirs[path] {
-		flags := inotify.IN_CREATE | inotify.IN_DELETE | inotify.IN_MOVE
+		flags := inotify.IN_CREATE | inotify.IN_DELETE | inotify.IN_MOVE |
+			inotify.IN_MODIFY | inotify.IN_CLOSE_WRITE
 		if err := watcher.AddWatch(path, flags); err != nil {
 			log.Printf("unable to watch directory: %s", err.Error())
 		} else {
 			watchDirs[path] = true
 		}
 	}
+	return watchDirs[path]
+}
+
+// type globWatch tells a prospector about files created that match its globs,
+// so it can start harvesting them without waiting for its next scan.
+type globWatch struct {
+	sync.Mutex
+	globs   []string
+	exclude globList
+	created map[string]bool // files created since the last call to take
+	wake    chan struct{}
+}
+
+// starts telling a prospector about created files matching globs.
+func watchGlobs(globs []string, exclude globList) *globWatch {
+	w := &globWatch{
+		globs:   globs,
+		exclude: exclude,
+		created: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	globWatches[w] = true
+	return w
+}
+
+func (w *globWatch) close() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	delete(globWatches, w)
+}
+
+// returns the files created since it was last called.
+func (w *globWatch) take() map[string]bool {
+	w.Lock()
+	defer w.Unlock()
+	created := w.created
+	w.created = make(map[string]bool)
+	return created
+}
+
+// wakes the prospector if one of its globs matches a newly created file.
+// Files in the working directory are watched as ./name, and their globs may
+// not say so.
+func (w *globWatch) add(path string) {
+	if w.exclude.match(path) {
+		return
+	}
+	for _, glob := range w.globs {
+		for _, p := range []string{path, filepath.Clean(path)} {
+			if globMatch(glob, p) {
+				w.Lock()
+				w.created[p] = true
+				w.Unlock()
+				select {
+				case w.wake <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	}
+}
+
+// reports whether files matching the watch's globs could be created in dir.
+func (w *globWatch) contains(dir string) bool {
+	if w.exclude.match(dir) {
+		return false
+	}
+	for _, glob := range w.globs {
+		if globContains(glob, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// tells prospectors about a newly created file or directory.  Directories
+// that could hold files matching a prospector's globs are watched, and
+// anything created in them before the watch started is looked at too.
+func fileCreated(path string, isDir bool) {
+	watchLock.Lock()
+	watches := make([]*globWatch, 0, len(globWatches))
+	for w := range globWatches {
+		watches = append(watches, w)
+	}
+	watchLock.Unlock()
+
+	for _, w := range watches {
+		if !isDir {
+			w.add(path)
+			continue
+		}
+		if !w.contains(path) {
+			continue
+		}
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			switch {
+			case err != nil:
+				return nil
+			case !info.IsDir():
+				w.add(p)
+			case w.contains(p):
+				watchDir(p)
+			default:
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
 }
 
 func init() {